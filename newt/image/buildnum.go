@@ -0,0 +1,138 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"mynewt.apache.org/newt/util"
+)
+
+const (
+	BUILD_NUM_LOCK_TIMEOUT = 30 * time.Second
+)
+
+/*
+ * Acquires an exclusive lock on <path>.lock (see tryLockFile()).  The lock
+ * is held on a separate file because the counter itself is replaced by
+ * rename when it is written, and a lock on the old file would not exclude a
+ * build that opens the new one.  The OS drops the lock if the holder dies,
+ * so a crashed build cannot leave a stale lock behind.  The returned
+ * function releases the lock.
+ */
+func lockFile(path string) (func(), error) {
+	lockPath := path + ".lock"
+	deadline := time.Now().Add(BUILD_NUM_LOCK_TIMEOUT)
+
+	for {
+		f, err := tryLockFile(lockPath)
+		if err != nil {
+			return nil, util.NewNewtError(fmt.Sprintf("Can't lock %s: %s",
+				lockPath, err.Error()))
+		}
+		if f != nil {
+			return func() { f.Close() }, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, util.NewNewtError(fmt.Sprintf("Timed out waiting "+
+				"for lock on %s", lockPath))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+/*
+ * Replaces the contents of path by writing a temporary file in the same
+ * directory and renaming it over path, so that readers never see a
+ * partially written file.
+ */
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path),
+		filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+/*
+ * Increments the build number stored in counterFile and uses the new value
+ * as the image's build number.  A missing or empty file counts as zero.
+ * Returns the version the image will be stamped with.
+ */
+func (image *Image) SetBuildNumFromCounter(
+	counterFile string) (ImageVersion, error) {
+
+	unlock, err := lockFile(counterFile)
+	if err != nil {
+		return image.version, err
+	}
+	defer unlock()
+
+	var buildNum uint64
+	data, err := ioutil.ReadFile(counterFile)
+	if err != nil && !os.IsNotExist(err) {
+		return image.version, util.NewNewtError(fmt.Sprintf("Can't read "+
+			"build counter %s: %s", counterFile, err.Error()))
+	}
+	if str := strings.TrimSpace(string(data)); str != "" {
+		buildNum, err = strconv.ParseUint(str, 10, 32)
+		if err != nil {
+			return image.version, util.NewNewtError(fmt.Sprintf("Invalid "+
+				"build counter in %s: %s", counterFile, str))
+		}
+	}
+	if buildNum == math.MaxUint32 {
+		return image.version, util.NewNewtError(fmt.Sprintf("Build "+
+			"counter in %s would overflow", counterFile))
+	}
+	buildNum++
+
+	err = writeFileAtomic(counterFile,
+		[]byte(strconv.FormatUint(buildNum, 10)+"\n"))
+	if err != nil {
+		return image.version, util.NewNewtError(fmt.Sprintf("Can't write "+
+			"build counter %s: %s", counterFile, err.Error()))
+	}
+
+	image.version.BuildNum = uint32(buildNum)
+	return image.version, nil
+}
@@ -0,0 +1,75 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBuildNumCounter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildnum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	counter := filepath.Join(dir, "counter")
+
+	/* A lock file left by an earlier build must not block this one. */
+	if err := ioutil.WriteFile(counter+".lock", nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	const builds = 8
+	var wg sync.WaitGroup
+	nums := make([]uint32, builds)
+	errs := make([]error, builds)
+	for i := 0; i < builds; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			vers, err := (&Image{}).SetBuildNumFromCounter(counter)
+			nums[i], errs[i] = vers.BuildNum, err
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[uint32]bool{}
+	for i, _ := range nums {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if seen[nums[i]] {
+			t.Errorf("build number %d handed out twice", nums[i])
+		}
+		seen[nums[i]] = true
+	}
+
+	data, err := ioutil.ReadFile(counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str := strings.TrimSpace(string(data)); str != "8" {
+		t.Errorf("counter is %q; expected 8", str)
+	}
+}
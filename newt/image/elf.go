@@ -0,0 +1,104 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+
+	"mynewt.apache.org/newt/util"
+)
+
+/*
+ * Loadable chunk of an ELF file, at its load (physical) address.
+ */
+type elfChunk struct {
+	addr uint64
+	sect *elf.Section
+}
+
+/*
+ * Produces a flat binary from an ELF file, in the same way as
+ * "objcopy -O binary": the contents of every allocated section are placed
+ * at their load address relative to the lowest one, and gaps are
+ * zero-filled.  A section's load address is derived from the PT_LOAD
+ * segment that contains it.
+ */
+func ElfToBin(elfPath string) ([]byte, error) {
+	ef, err := elf.Open(elfPath)
+	if err != nil {
+		return nil, util.NewNewtError(fmt.Sprintf("Can't open ELF file %s: "+
+			"%s", elfPath, err.Error()))
+	}
+	defer ef.Close()
+
+	chunks := []elfChunk{}
+	for _, sect := range ef.Sections {
+		if sect.Flags&elf.SHF_ALLOC == 0 || sect.Type == elf.SHT_NOBITS ||
+			sect.Size == 0 {
+
+			continue
+		}
+
+		for _, prog := range ef.Progs {
+			if prog.Type == elf.PT_LOAD && sect.Offset >= prog.Off &&
+				sect.Offset+sect.Size <= prog.Off+prog.Filesz {
+
+				chunks = append(chunks, elfChunk{
+					addr: prog.Paddr + sect.Offset - prog.Off,
+					sect: sect,
+				})
+				break
+			}
+		}
+	}
+	if len(chunks) == 0 {
+		return nil, util.NewNewtError(fmt.Sprintf("ELF file %s has no "+
+			"loadable sections", elfPath))
+	}
+
+	base := chunks[0].addr
+	end := chunks[0].addr + chunks[0].sect.Size
+	for _, chunk := range chunks[1:] {
+		if chunk.addr < base {
+			base = chunk.addr
+		}
+		if chunk.addr+chunk.sect.Size > end {
+			end = chunk.addr + chunk.sect.Size
+		}
+	}
+	if end-base > 1<<32 {
+		return nil, util.NewNewtError(fmt.Sprintf("Loadable sections of %s "+
+			"span too large a range (0x%x-0x%x)", elfPath, base, end))
+	}
+
+	bin := make([]byte, end-base)
+	for _, chunk := range chunks {
+		off := chunk.addr - base
+		_, err := io.ReadFull(chunk.sect.Open(), bin[off:off+chunk.sect.Size])
+		if err != nil {
+			return nil, util.NewNewtError(fmt.Sprintf("Can't read section "+
+				"%s from %s: %s", chunk.sect.Name, elfPath, err.Error()))
+		}
+	}
+
+	return bin, nil
+}
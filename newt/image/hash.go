@@ -0,0 +1,59 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"mynewt.apache.org/newt/util"
+)
+
+/*
+ * Decodes an image hash written in hex.  Upper or lower case digits, a
+ * "0x" prefix and surrounding whitespace are all accepted, so hashes from
+ * manifests, tools and scripts compare equal regardless of formatting.
+ */
+func ParseHashHex(s string) ([]byte, error) {
+	str := strings.TrimSpace(s)
+	if strings.HasPrefix(str, "0x") || strings.HasPrefix(str, "0X") {
+		str = str[2:]
+	}
+	if str == "" {
+		return nil, util.NewNewtError(fmt.Sprintf("Invalid hash \"%s\"", s))
+	}
+
+	hash, err := hex.DecodeString(str)
+	if err != nil {
+		return nil, util.NewNewtError(fmt.Sprintf("Invalid hash \"%s\": %s",
+			s, err.Error()))
+	}
+
+	return hash, nil
+}
+
+/*
+ * Reports whether two image hashes are the same.  Empty hashes never match.
+ */
+func HashEqual(a []byte, b []byte) bool {
+	return len(a) != 0 && bytes.Equal(a, b)
+}
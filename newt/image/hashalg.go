@@ -0,0 +1,130 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+
+	"mynewt.apache.org/newt/util"
+)
+
+/*
+ * Digest that can be used for the image hash TLV.
+ */
+type HashAlg struct {
+	Name    string           /* Identifier, e.g., "sha256" */
+	New     func() hash.Hash /* Constructor */
+	TlvType uint8            /* TLV holding the digest */
+	Flag    uint32           /* Header flag indicating the TLV */
+}
+
+const HASH_ALG_SHA256 = "sha256"
+
+var hashAlgs = map[string]*HashAlg{
+	HASH_ALG_SHA256: {
+		Name:    HASH_ALG_SHA256,
+		New:     sha256.New,
+		TlvType: IMAGE_TLV_SHA256,
+		Flag:    IMAGE_F_SHA256,
+	},
+}
+
+/*
+ * Header flags with a fixed meaning, which a digest cannot claim.
+ */
+const reservedHdrFlags = IMAGE_F_PIC | IMAGE_F_SHA256 |
+	IMAGE_F_PKCS15_RSA2048_SHA256 | IMAGE_F_ECDSA224_SHA256
+
+/*
+ * Makes a digest available to image generation and verification.  The
+ * name, flag and TLV type must not already be in use, either by another
+ * digest or by any other kind of TLV.
+ */
+func RegisterHashAlg(alg *HashAlg) error {
+	if alg.Name == "" || alg.New == nil || alg.Flag == 0 ||
+		alg.TlvType == 0 {
+
+		return util.NewNewtError("Incomplete hash algorithm definition")
+	}
+	if alg.Flag&reservedHdrFlags != 0 {
+		return util.NewNewtError(fmt.Sprintf("Hash algorithm %s uses "+
+			"reserved header flag(s) 0x%x", alg.Name,
+			alg.Flag&reservedHdrFlags))
+	}
+	if _, ok := tlvTypeInfos[alg.TlvType]; ok {
+		return util.NewNewtError(fmt.Sprintf("Hash algorithm %s TLV type "+
+			"%d already used by %s", alg.Name, alg.TlvType,
+			TlvTypeName(alg.TlvType)))
+	}
+	for _, other := range hashAlgs {
+		if other.Name == alg.Name || other.Flag&alg.Flag != 0 {
+			return util.NewNewtError(fmt.Sprintf("Hash algorithm %s "+
+				"conflicts with %s", alg.Name, other.Name))
+		}
+	}
+
+	hashAlgs[alg.Name] = alg
+	tlvTypeInfos[alg.TlvType] = tlvTypeInfo{
+		strings.ToUpper(alg.Name),
+		fmt.Sprintf("%s image hash", strings.ToUpper(alg.Name)),
+		true,
+	}
+
+	return nil
+}
+
+func isHashTlv(tlvType uint8) bool {
+	for _, alg := range hashAlgs {
+		if alg.TlvType == tlvType {
+			return true
+		}
+	}
+	return false
+}
+
+func LookupHashAlg(name string) (*HashAlg, error) {
+	alg, ok := hashAlgs[name]
+	if !ok {
+		return nil, util.NewNewtError(fmt.Sprintf("Unknown hash algorithm "+
+			"\"%s\"", name))
+	}
+	return alg, nil
+}
+
+/*
+ * Registered digests, sorted by name.
+ */
+func sortedHashAlgs() []*HashAlg {
+	names := make([]string, 0, len(hashAlgs))
+	for name, _ := range hashAlgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	algs := make([]*HashAlg, len(names))
+	for i, name := range names {
+		algs[i] = hashAlgs[name]
+	}
+	return algs
+}
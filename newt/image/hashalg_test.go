@@ -0,0 +1,188 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha512"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testSha512Tlv = 0x40
+
+func registerTestSha512(t *testing.T) func() {
+	err := RegisterHashAlg(&HashAlg{
+		Name:    "sha512",
+		New:     sha512.New,
+		TlvType: testSha512Tlv,
+		Flag:    0x00000100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		delete(hashAlgs, "sha512")
+		delete(tlvTypeInfos, testSha512Tlv)
+	}
+}
+
+func TestRegisterHashAlgConflicts(t *testing.T) {
+	defer registerTestSha512(t)()
+
+	bad := []*HashAlg{
+		/* Name already registered. */
+		{Name: "sha512", New: sha512.New, TlvType: 0x41, Flag: 0x200},
+		/* TLV type of the RSA signature. */
+		{Name: "a", New: sha512.New, TlvType: IMAGE_TLV_RSA2048,
+			Flag: 0x200},
+		/* TLV type of another digest. */
+		{Name: "b", New: sha512.New, TlvType: testSha512Tlv, Flag: 0x200},
+		/* Signature flag. */
+		{Name: "c", New: sha512.New, TlvType: 0x41,
+			Flag: IMAGE_F_ECDSA224_SHA256},
+		/* Flag of another digest. */
+		{Name: "d", New: sha512.New, TlvType: 0x41, Flag: 0x100},
+		/* Incomplete definitions. */
+		{Name: "e", New: sha512.New, TlvType: 0, Flag: 0x200},
+		{Name: "f", New: nil, TlvType: 0x41, Flag: 0x200},
+		{Name: "g", New: sha512.New, TlvType: 0x41, Flag: 0},
+	}
+	for _, alg := range bad {
+		if err := RegisterHashAlg(alg); err == nil {
+			t.Errorf("conflicting hash algorithm %s registered", alg.Name)
+			delete(hashAlgs, alg.Name)
+		}
+	}
+}
+
+func TestHashAlgSha512(t *testing.T) {
+	defer registerTestSha512(t)()
+
+	image := newTestImage(t, "1.0.0")
+	if err := image.SetHashAlg("sha512"); err != nil {
+		t.Fatal(err)
+	}
+	_, pi := generateTestImage(t, image, testBody(500))
+
+	if pi.Hdr.Flags&IMAGE_F_SHA256 != 0 || pi.FindTlv(IMAGE_TLV_SHA256) != nil {
+		t.Fatal("sha512 image carries SHA256 hash")
+	}
+	if err := pi.VerifyStructure(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pi.VerifyHash(); err != nil {
+		t.Fatal(err)
+	}
+	if d := pi.DescribeTlvs()[0].Description; d != "SHA512 of header+body" {
+		t.Errorf("hash TLV described as %q", d)
+	}
+	if strings.Contains(pi.OneLineSummary(), "hash=none") {
+		t.Errorf("summary lacks hash: %s", pi.OneLineSummary())
+	}
+	if _, err := GenerateSetManifest([]*ParsedImage{pi},
+		[]string{"app"}); err != nil {
+
+		t.Error(err)
+	}
+
+	/* Re-hashing after a body change must keep the digest. */
+	if err := pi.ReplaceBody(testBody(600), nil, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if pi.Hdr.Flags&IMAGE_F_SHA256 != 0 || pi.FindTlv(IMAGE_TLV_SHA256) != nil {
+		t.Fatal("ReplaceBody added a SHA256 hash")
+	}
+	if err := pi.VerifyStructure(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pi.VerifyHash(); err != nil {
+		t.Fatal(err)
+	}
+
+	/* Signatures are only defined over SHA256. */
+	_, ecKey := testKeys(t)
+	if err := pi.ReplaceBody(testBody(600),
+		[]crypto.PrivateKey{ecKey}, 0, 0); err == nil {
+
+		t.Error("sha512 image signed")
+	}
+	image.SetSigningPrivateKey(ecKey, 0)
+	err := image.GenerateFrom(strings.NewReader("x"), 1, &strings.Builder{})
+	if err == nil {
+		t.Error("sha512 image signed")
+	}
+}
+
+func TestHashFlagSet(t *testing.T) {
+	rsaKey, ecKey := testKeys(t)
+
+	/* The SHA256 flag accompanies the SHA256 TLV, signed or not. */
+	unsigned := newTestImage(t, "1.0.0")
+	signed := newTestImage(t, "1.0.0")
+	signed.SetSigningPrivateKey(rsaKey, 0)
+	signed.SetSigningPrivateKey(ecKey, 0)
+	for _, image := range []*Image{unsigned, signed} {
+		_, pi := generateTestImage(t, image, testBody(10))
+		if pi.Hdr.Flags&IMAGE_F_SHA256 == 0 {
+			t.Errorf("SHA256 flag not set; flags=0x%08x", pi.Hdr.Flags)
+		}
+		if pi.FindTlv(IMAGE_TLV_SHA256) == nil {
+			t.Error("SHA256 TLV missing")
+		}
+	}
+
+	/* Other digests set their own flag. */
+	defer registerTestSha512(t)()
+	image := newTestImage(t, "1.0.0")
+	image.SetHashAlg("sha512")
+	_, pi := generateTestImage(t, image, testBody(10))
+	alg := pi.HashAlg()
+	if alg.Name != "sha512" || pi.Hdr.Flags&alg.Flag == 0 {
+		t.Errorf("sha512 flag not set; flags=0x%08x", pi.Hdr.Flags)
+	}
+}
+
+func TestSidecarRequiresSha256(t *testing.T) {
+	defer registerTestSha512(t)()
+
+	dir, err := ioutil.TempDir("", "image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := newTestImage(t, "1.0.0")
+	image.SetHashAlg("sha512")
+	image.SetSha256Sidecar(SIDECAR_IMAGE_HASH)
+	image.targetImg = filepath.Join(dir, "app.img")
+	err = image.generateFile(bytes.NewReader(testBody(10)), 10)
+	if err == nil {
+		t.Fatal("sha512 image hash written to .sha256 sidecar")
+	}
+	if _, err := os.Stat(image.targetImg); !os.IsNotExist(err) {
+		t.Error("image written despite sidecar error")
+	}
+}
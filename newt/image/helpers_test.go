@@ -0,0 +1,95 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"sync"
+	"testing"
+)
+
+var (
+	testKeysOnce sync.Once
+	testRsaKey   *rsa.PrivateKey
+	testEcKey    *ecdsa.PrivateKey
+)
+
+/*
+ * Keys shared by all tests; RSA key generation is too slow to repeat.
+ */
+func testKeys(t testing.TB) (*rsa.PrivateKey, *ecdsa.PrivateKey) {
+	testKeysOnce.Do(func() {
+		var err error
+		testRsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			panic(err)
+		}
+		testEcKey, err = ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+	})
+
+	return testRsaKey, testEcKey
+}
+
+/*
+ * Deterministic app binary contents.
+ */
+func testBody(size int) []byte {
+	body := make([]byte, size)
+	for i, _ := range body {
+		body[i] = byte(i*7 + i>>8)
+	}
+	return body
+}
+
+func newTestImage(t testing.TB, version string) *Image {
+	image := &Image{}
+	if err := image.SetVersion(version); err != nil {
+		t.Fatalf("SetVersion: %v", err)
+	}
+	return image
+}
+
+/*
+ * Generates an image in memory and returns both its bytes and the parsed
+ * result.
+ */
+func generateTestImage(t testing.TB, image *Image,
+	body []byte) ([]byte, *ParsedImage) {
+
+	buf := &bytes.Buffer{}
+	err := image.GenerateFrom(bytes.NewReader(body), int64(len(body)), buf)
+	if err != nil {
+		t.Fatalf("GenerateFrom: %v", err)
+	}
+
+	pi, err := ReadImage(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadImage: %v", err)
+	}
+
+	return buf.Bytes(), pi
+}
@@ -32,8 +32,10 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"math"
 	"math/big"
 	"os"
 	"path/filepath"
@@ -56,17 +58,46 @@ type ImageVersion struct {
 	BuildNum uint32
 }
 
+func (v ImageVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d.%d", v.Major, v.Minor, v.Rev, v.BuildNum)
+}
+
 type Image struct {
 	builder *builder.Builder
 
 	sourceBin    string
+	sourceElf    string
+	fromElf      bool
 	targetImg    string
 	manifestFile string
 	version      ImageVersion
 	signingRSA   *rsa.PrivateKey
 	signingEC    *ecdsa.PrivateKey
 	keyId        uint8
+	ecKeyId      uint8
 	hash         []byte
+	vcsHash      string
+	totalSize    int
+	tlvs         []ImageTrailerTlv
+	infoTlvs     []infoTlv
+	sidecar      int
+	merkleChunk  int
+	useFileCrc   bool
+	fileCrc      uint32
+	fileHash     []byte
+	tlvAlign     int
+	hashScope    int
+	checkRepro   bool
+	hashAlg      *HashAlg
+	wideHdr      bool
+}
+
+/*
+ * Unsigned TLV added to the trailer after the signatures.
+ */
+type infoTlv struct {
+	tlvType uint8
+	data    []byte
 }
 
 type ImageHdr struct {
@@ -82,6 +113,22 @@ type ImageHdr struct {
 	Pad3  uint32
 }
 
+/*
+ * Alternate header for images whose body size does not fit in 32 bits.  It
+ * is the same size as ImageHdr and is told apart by its magic.
+ */
+type ImageHdr64 struct {
+	Magic uint32
+	TlvSz uint16
+	KeyId uint8
+	Pad1  uint8
+	HdrSz uint16
+	Pad2  uint16
+	Flags uint32
+	Vers  ImageVersion
+	ImgSz uint64
+}
+
 type ImageTrailerTlv struct {
 	Type uint8
 	Pad  uint8
@@ -89,7 +136,8 @@ type ImageTrailerTlv struct {
 }
 
 const (
-	IMAGE_MAGIC = 0x96f3b83c /* Image header magic */
+	IMAGE_MAGIC    = 0x96f3b83c /* Image header magic */
+	IMAGE_MAGIC_64 = 0x96f3b83d /* Header with 64-bit image size */
 )
 
 const (
@@ -113,8 +161,99 @@ const (
 	IMAGE_TLV_SHA256   = 1
 	IMAGE_TLV_RSA2048  = 2
 	IMAGE_TLV_ECDSA224 = 3
+	IMAGE_TLV_VCS_HASH = 4 /* Source revision image was built from */
+	IMAGE_TLV_COMPRESS = 5 /* Compression scheme of the body */
+	IMAGE_TLV_MERKLE   = 6 /* Merkle root over body chunks */
+	IMAGE_TLV_BSP_NAME = 7 /* BSP the image was built for */
+	IMAGE_TLV_MIN_PREV = 8 /* Oldest version this image may replace */
+	IMAGE_TLV_DEV_MODS = 9 /* Device models the image may run on */
+)
+
+/*
+ * Values of the compression scheme TLV.
+ */
+const (
+	IMAGE_COMPRESS_NONE     = 0 /* Body is stored uncompressed */
+	IMAGE_COMPRESS_IDENTITY = 1 /* Identity encoding; same as none */
+)
+
+var compressNames = map[uint8]string{
+	IMAGE_COMPRESS_NONE:     "none",
+	IMAGE_COMPRESS_IDENTITY: "identity",
+}
+
+const (
+	IMAGE_VCS_HASH_MAX_LEN = 64
+	IMAGE_BSP_NAME_MAX_LEN = 128
+	IMAGE_DEV_MODELS_MAX   = 64
+	RSA_KEY_BITS           = 2048 /* Size of RSA signing keys */
+	RSA2048_SIG_LEN        = 256  /* Length of an RSA2048 signature TLV */
+)
+
+/*
+ * What the image hash is computed over.
+ */
+const (
+	HASH_SCOPE_HDR_BODY = 0 /* Header (incl. padding) and body; default */
+	HASH_SCOPE_BODY     = 1 /* Body only */
+)
+
+/*
+ * Contents of the optional <image>.sha256 file.
+ */
+const (
+	SIDECAR_NONE       = 0
+	SIDECAR_IMAGE_HASH = 1 /* Image hash; SHA256-hashed images only */
+	SIDECAR_FILE_HASH  = 2 /* SHA256 of the complete .img file */
 )
 
+/*
+ * Description of a trailer TLV, for reporting.
+ */
+type TlvDescription struct {
+	Type        uint8
+	Name        string
+	Len         int
+	Description string
+	Security    bool /* TLV is used to establish image integrity */
+}
+
+type tlvTypeInfo struct {
+	name     string
+	desc     string
+	security bool
+}
+
+var tlvTypeInfos = map[uint8]tlvTypeInfo{
+	IMAGE_TLV_SHA256: {
+		"SHA256", "SHA256 image hash", true,
+	},
+	IMAGE_TLV_RSA2048: {
+		"RSA2048", "RSA2048 PKCS#1 v1.5 signature over hash", true,
+	},
+	IMAGE_TLV_ECDSA224: {
+		"ECDSA224", "ECDSA signature over hash", true,
+	},
+	IMAGE_TLV_VCS_HASH: {
+		"VCS_HASH", "Source revision the image was built from", false,
+	},
+	IMAGE_TLV_COMPRESS: {
+		"COMPRESS", "Compression scheme of the body", false,
+	},
+	IMAGE_TLV_MERKLE: {
+		"MERKLE", "Merkle root over fixed-size body chunks", true,
+	},
+	IMAGE_TLV_BSP_NAME: {
+		"BSP_NAME", "BSP the image was built for", false,
+	},
+	IMAGE_TLV_MIN_PREV: {
+		"MIN_PREV", "Oldest installed version this image may replace", false,
+	},
+	IMAGE_TLV_DEV_MODS: {
+		"DEV_MODS", "Device model IDs the image may be installed on", false,
+	},
+}
+
 /*
  * Data that's going to go to build manifest file
  */
@@ -122,6 +261,9 @@ type ImageManifest struct {
 	Date    string              `json:"build_time"`
 	Version string              `json:"build_version"`
 	Hash    string              `json:"id"`
+	VcsHash string              `json:"vcs_hash,omitempty"`
+	FileCrc string              `json:"file_crc32,omitempty"`
+	Size    int                 `json:"image_size,omitempty"`
 	Image   string              `json:"image"`
 	Pkgs    []*ImageManifestPkg `json:"pkgs"`
 	TgtVars []string            `json:"target"`
@@ -142,6 +284,7 @@ func NewImage(b *builder.Builder) (*Image, error) {
 	}
 
 	image.sourceBin = b.AppElfPath() + ".bin"
+	image.sourceElf = b.AppElfPath()
 	image.targetImg = b.AppImgPath()
 	image.manifestFile = b.AppPath() + "manifest.json"
 	return image, nil
@@ -155,7 +298,7 @@ func (image *Image) ManifestFile() string {
 	return image.manifestFile
 }
 
-func (image *Image) SetVersion(versStr string) error {
+func ParseVersion(versStr string) (ImageVersion, error) {
 	var err error
 	var major uint64
 	var minor uint64
@@ -165,34 +308,46 @@ func (image *Image) SetVersion(versStr string) error {
 	components := strings.Split(versStr, ".")
 	major, err = strconv.ParseUint(components[0], 10, 8)
 	if err != nil {
-		return util.NewNewtError(fmt.Sprintf("Invalid version string %s",
-			versStr))
+		return ImageVersion{}, util.NewNewtError(fmt.Sprintf(
+			"Invalid version string %s", versStr))
 	}
 	if len(components) > 1 {
 		minor, err = strconv.ParseUint(components[1], 10, 8)
 		if err != nil {
-			return util.NewNewtError(fmt.Sprintf("Invalid version string %s",
-				versStr))
+			return ImageVersion{}, util.NewNewtError(fmt.Sprintf(
+				"Invalid version string %s", versStr))
 		}
 	}
 	if len(components) > 2 {
 		rev, err = strconv.ParseUint(components[2], 10, 16)
 		if err != nil {
-			return util.NewNewtError(fmt.Sprintf("Invalid version string %s",
-				versStr))
+			return ImageVersion{}, util.NewNewtError(fmt.Sprintf(
+				"Invalid version string %s", versStr))
 		}
 	}
 	if len(components) > 3 {
 		buildNum, err = strconv.ParseUint(components[3], 10, 32)
 		if err != nil {
-			return util.NewNewtError(fmt.Sprintf("Invalid version string %s",
-				versStr))
+			return ImageVersion{}, util.NewNewtError(fmt.Sprintf(
+				"Invalid version string %s", versStr))
 		}
 	}
-	image.version.Major = uint8(major)
-	image.version.Minor = uint8(minor)
-	image.version.Rev = uint16(rev)
-	image.version.BuildNum = uint32(buildNum)
+
+	return ImageVersion{
+		Major:    uint8(major),
+		Minor:    uint8(minor),
+		Rev:      uint16(rev),
+		BuildNum: uint32(buildNum),
+	}, nil
+}
+
+func (image *Image) SetVersion(versStr string) error {
+	var err error
+
+	image.version, err = ParseVersion(versStr)
+	if err != nil {
+		return err
+	}
 	log.Debugf("Assigning version number %d.%d.%d.%d\n",
 		image.version.Major, image.version.Minor,
 		image.version.Rev, image.version.BuildNum)
@@ -207,12 +362,24 @@ func (image *Image) SetVersion(versStr string) error {
 	return nil
 }
 
-func (image *Image) SetSigningKey(fileName string, keyId uint8) error {
+/*
+ * Reads an RSA or EC private key in PEM format.  The returned key is either
+ * an *rsa.PrivateKey or an *ecdsa.PrivateKey.
+ */
+func ReadPrivateKey(fileName string) (crypto.PrivateKey, error) {
 	data, err := ioutil.ReadFile(fileName)
 	if err != nil {
-		return util.NewNewtError(fmt.Sprintf("Error reading key file: %s", err))
+		return nil, util.NewNewtError(fmt.Sprintf("Error reading key file: "+
+			"%s", err))
 	}
 
+	return ParsePrivateKey(data)
+}
+
+/*
+ * Parses a PEM encoded RSA or EC private key.
+ */
+func ParsePrivateKey(data []byte) (crypto.PrivateKey, error) {
 	block, _ := pem.Decode(data)
 	if block != nil && block.Type == "RSA PRIVATE KEY" {
 		/*
@@ -221,10 +388,10 @@ func (image *Image) SetSigningKey(fileName string, keyId uint8) error {
 		 */
 		privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
 		if err != nil {
-			return util.NewNewtError(fmt.Sprintf("Private key parsing "+
+			return nil, util.NewNewtError(fmt.Sprintf("Private key parsing "+
 				"failed: %s", err))
 		}
-		image.signingRSA = privateKey
+		return privateKey, nil
 	}
 	if block != nil && block.Type == "EC PRIVATE KEY" {
 		/*
@@ -232,21 +399,402 @@ func (image *Image) SetSigningKey(fileName string, keyId uint8) error {
 		 */
 		privateKey, err := x509.ParseECPrivateKey(block.Bytes)
 		if err != nil {
-			return util.NewNewtError(fmt.Sprintf("Private key parsing "+
+			return nil, util.NewNewtError(fmt.Sprintf("Private key parsing "+
 				"failed: %s", err))
 		}
+		return privateKey, nil
+	}
+
+	return nil, util.NewNewtError("Unknown private key format, EC/RSA " +
+		"private key in PEM format only.")
+}
+
+/*
+ * Loads an RSA or EC private key to sign the image with.  Call once with
+ * each kind of key to have the image signed with both.
+ */
+func (image *Image) SetSigningKey(fileName string, keyId uint8) error {
+	key, err := ReadPrivateKey(fileName)
+	if err != nil {
+		return err
+	}
+
+	return image.SetSigningPrivateKey(key, keyId)
+}
+
+/*
+ * Same as SetSigningKey(), but with an already loaded *rsa.PrivateKey or
+ * *ecdsa.PrivateKey.  The header's key ID identifies the RSA key if there is
+ * one, else the EC key.
+ */
+func (image *Image) SetSigningPrivateKey(key crypto.PrivateKey,
+	keyId uint8) error {
+
+	switch privateKey := key.(type) {
+	case *rsa.PrivateKey:
+		if err := checkRsaKeySize(privateKey); err != nil {
+			return err
+		}
+		image.signingRSA = privateKey
+		image.keyId = keyId
+	case *ecdsa.PrivateKey:
 		image.signingEC = privateKey
+		image.ecKeyId = keyId
+	default:
+		return util.NewNewtError(fmt.Sprintf("Unsupported private key "+
+			"type %T", key))
+	}
+
+	return nil
+}
+
+/*
+ * The RSA2048 signature TLV and header flag only describe signatures made
+ * with 2048-bit keys, so smaller and larger keys are both refused.
+ */
+func checkRsaKeySize(key *rsa.PrivateKey) error {
+	bits := key.N.BitLen()
+	if bits != RSA_KEY_BITS {
+		return util.NewNewtError(fmt.Sprintf("Unsupported RSA key size (%d "+
+			"bits); image signatures require a %d-bit key", bits,
+			RSA_KEY_BITS))
+	}
+	return nil
+}
+
+func (image *Image) SetVcsHash(vcsHash string) error {
+	if len(vcsHash) > IMAGE_VCS_HASH_MAX_LEN {
+		return util.NewNewtError(fmt.Sprintf("VCS hash too long (%d > %d): "+
+			"%s", len(vcsHash), IMAGE_VCS_HASH_MAX_LEN, vcsHash))
+	}
+	image.vcsHash = vcsHash
+	image.setInfoTlv(IMAGE_TLV_VCS_HASH, []byte(vcsHash))
+
+	return nil
+}
+
+/*
+ * Selects what the image hash covers, for bootloaders that hash only the
+ * body.  The scope is not recorded in the image, so the verifier must be
+ * told which scope to use.
+ */
+func (image *Image) SetHashScope(scope int) error {
+	if scope != HASH_SCOPE_HDR_BODY && scope != HASH_SCOPE_BODY {
+		return util.NewNewtError(fmt.Sprintf("Invalid hash scope %d", scope))
+	}
+	image.hashScope = scope
+
+	return nil
+}
+
+/*
+ * Selects the digest used for the image hash TLV by its registered name.
+ * Signatures are computed over SHA256, so signed images must use
+ * HASH_ALG_SHA256.
+ */
+func (image *Image) SetHashAlg(name string) error {
+	alg, err := LookupHashAlg(name)
+	if err != nil {
+		return err
+	}
+	image.hashAlg = alg
+
+	return nil
+}
+
+/*
+ * Makes Generate() use the ImageHdr64 header even if the body size fits in
+ * the standard header.  Bodies of 4GB or more always use it.
+ */
+func (image *Image) SetWideHeader(wide bool) {
+	image.wideHdr = wide
+}
+
+/*
+ * Converts a header to its 64-bit size form.
+ */
+func wideImageHdr(hdr *ImageHdr, imgSz uint64) *ImageHdr64 {
+	return &ImageHdr64{
+		Magic: IMAGE_MAGIC_64,
+		TlvSz: hdr.TlvSz,
+		KeyId: hdr.KeyId,
+		Pad1:  hdr.Pad1,
+		HdrSz: hdr.HdrSz,
+		Pad2:  hdr.Pad2,
+		Flags: hdr.Flags,
+		Vers:  hdr.Vers,
+		ImgSz: imgSz,
+	}
+}
+
+func (image *Image) hashAlgorithm() *HashAlg {
+	if image.hashAlg == nil {
+		return hashAlgs[HASH_ALG_SHA256]
+	}
+	return image.hashAlg
+}
+
+/*
+ * Adds a TLV naming the BSP the image was built for (e.g.,
+ * "@apache-mynewt-core/hw/bsp/nrf52dk").
+ */
+func (image *Image) SetBspName(bspName string) error {
+	if len(bspName) > IMAGE_BSP_NAME_MAX_LEN {
+		return util.NewNewtError(fmt.Sprintf("BSP name too long (%d > %d): "+
+			"%s", len(bspName), IMAGE_BSP_NAME_MAX_LEN, bspName))
+	}
+	image.setInfoTlv(IMAGE_TLV_BSP_NAME, []byte(bspName))
+
+	return nil
+}
+
+/*
+ * Adds a TLV listing the device model IDs the image is built for, so that
+ * it is refused by hardware it was not meant for.  Like the other
+ * informational TLVs, it follows the signature and is not covered by the
+ * hash or signature; anyone can change it without invalidating the image.
+ * It guards against mistakes, not against an attacker.
+ */
+func (image *Image) SetDeviceModels(models []uint32) error {
+	if len(models) == 0 || len(models) > IMAGE_DEV_MODELS_MAX {
+		return util.NewNewtError(fmt.Sprintf("Invalid device model count "+
+			"%d; must be 1-%d", len(models), IMAGE_DEV_MODELS_MAX))
+	}
+
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, models)
+	image.setInfoTlv(IMAGE_TLV_DEV_MODS, buf.Bytes())
+
+	return nil
+}
+
+/*
+ * Adds a TLV carrying the oldest version a device may be running for this
+ * image to be accepted.  Devices on anything older must first install the
+ * intermediate updates.  The TLV follows the signature, so it is not
+ * protected against tampering; it cannot serve as anti-rollback on its own.
+ */
+func (image *Image) SetMinPrevVersion(versStr string) error {
+	vers, err := ParseVersion(versStr)
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, &vers)
+	image.setInfoTlv(IMAGE_TLV_MIN_PREV, buf.Bytes())
+
+	return nil
+}
+
+/*
+ * Adds a TLV declaring how the body is compressed.  Only uncompressed
+ * bodies are supported for now.
+ */
+func (image *Image) SetCompression(scheme uint8) error {
+	if _, ok := compressNames[scheme]; !ok {
+		return util.NewNewtError(fmt.Sprintf("Unsupported compression "+
+			"scheme %d", scheme))
+	}
+	image.setInfoTlv(IMAGE_TLV_COMPRESS, []byte{scheme})
+
+	return nil
+}
+
+/*
+ * Adds a TLV with the root of a Merkle tree over body chunks of the given
+ * size.  Zero disables the TLV.
+ */
+func (image *Image) SetMerkleChunkSize(chunkSize int) error {
+	if chunkSize < 0 {
+		return util.NewNewtError(fmt.Sprintf("Invalid Merkle chunk size %d",
+			chunkSize))
+	}
+	image.merkleChunk = chunkSize
+
+	return nil
+}
+
+func CompressionName(scheme uint8) string {
+	name, ok := compressNames[scheme]
+	if !ok {
+		return fmt.Sprintf("unknown(%d)", scheme)
+	}
+	return name
+}
+
+func (image *Image) setInfoTlv(tlvType uint8, data []byte) {
+	for i, _ := range image.infoTlvs {
+		if image.infoTlvs[i].tlvType == tlvType {
+			image.infoTlvs[i].data = data
+			return
+		}
+	}
+	image.infoTlvs = append(image.infoTlvs, infoTlv{tlvType, data})
+}
+
+func TlvTypeName(tlvType uint8) string {
+	info, ok := tlvTypeInfos[tlvType]
+	if !ok {
+		return fmt.Sprintf("UNKNOWN(%d)", tlvType)
+	}
+	return info.name
+}
+
+/*
+ * Pads each TLV so that the next one starts at a multiple of align bytes
+ * from the start of the image.  The number of padding bytes following a
+ * TLV's data is stored in its Pad field.  The app binary is zero-padded as
+ * needed so that the first TLV is aligned as well; the padding is part of
+ * the image body.  Zero or one disables padding.
+ */
+func (image *Image) SetTlvAlign(align int) error {
+	if align < 0 || align > 256 {
+		return util.NewNewtError(fmt.Sprintf("Invalid TLV alignment %d",
+			align))
+	}
+	image.tlvAlign = align
+
+	return nil
+}
+
+/*
+ * Number of zero bytes appended to an app binary of binSize bytes so that
+ * the trailer starts at an aligned image offset.
+ */
+func (image *Image) bodyPad(binSize int64) int64 {
+	if image.tlvAlign <= 1 {
+		return 0
+	}
+	align := int64(image.tlvAlign)
+	return (align - (IMAGE_HEADER_SIZE+binSize)%align) % align
+}
+
+/*
+ * Padding after a TLV.  The trailer starts aligned (see bodyPad()), so
+ * every TLV that ends aligned leaves the next one aligned too.
+ */
+func (image *Image) tlvPad(dataLen int) int {
+	return alignPad(4+dataLen, image.tlvAlign)
+}
+
+/*
+ * Number of trailer bytes taken up by a TLV with the given data length.
+ */
+func (image *Image) tlvFootprint(dataLen int) uint16 {
+	return uint16(4 + dataLen + image.tlvPad(dataLen))
+}
+
+func (image *Image) writeTlv(w io.Writer, tlvType uint8, data []byte) error {
+	tlv := &ImageTrailerTlv{
+		Type: tlvType,
+		Pad:  uint8(image.tlvPad(len(data))),
+		Len:  uint16(len(data)),
+	}
+	err := binary.Write(w, binary.LittleEndian, tlv)
+	if err != nil {
+		return util.NewNewtError(fmt.Sprintf("Failed to serialize image "+
+			"trailer: %s", err.Error()))
 	}
-	if image.signingEC == nil && image.signingRSA == nil {
-		return util.NewNewtError("Unknown private key format, EC/RSA private " +
-			"key in PEM format only.")
+	_, err = w.Write(data)
+	if err != nil {
+		return util.NewNewtError(fmt.Sprintf("Failed to append TLV: %s",
+			err.Error()))
 	}
-	image.keyId = keyId
+	_, err = w.Write(make([]byte, tlv.Pad))
+	if err != nil {
+		return util.NewNewtError(fmt.Sprintf("Failed to append TLV: %s",
+			err.Error()))
+	}
+	image.tlvs = append(image.tlvs, *tlv)
 
 	return nil
 }
 
+func signRsa(key *rsa.PrivateKey, hash []byte) ([]byte, error) {
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash)
+	if err != nil {
+		return nil, util.NewNewtError(fmt.Sprintf(
+			"Failed to compute signature: %s", err))
+	}
+
+	return signature, nil
+}
+
+/*
+ * Returns the DER encoded signature, zero-padded to the fixed TLV length.
+ */
+/*
+ * Produces a DER-encoded ECDSA signature, with no padding.
+ */
+func signEcDer(key *ecdsa.PrivateKey, hash []byte) ([]byte, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash)
+	if err != nil {
+		return nil, util.NewNewtError(fmt.Sprintf(
+			"Failed to compute signature: %s", err))
+	}
+
+	var ECDSA ECDSASig
+	ECDSA.R = r
+	ECDSA.S = s
+	signature, err := asn1.Marshal(ECDSA)
+	if err != nil {
+		return nil, util.NewNewtError(fmt.Sprintf(
+			"Failed to construct signature: %s", err))
+	}
+
+	return signature, nil
+}
+
+/*
+ * Produces an ECDSA signature for the ECDSA224 TLV: DER, zero-padded to the
+ * fixed TLV length.
+ */
+func signEc(key *ecdsa.PrivateKey, hash []byte) ([]byte, error) {
+	signature, err := signEcDer(key, hash)
+	if err != nil {
+		return nil, err
+	}
+	if len(signature) > 68 {
+		return nil, util.NewNewtError(fmt.Sprintf(
+			"Something is really wrong\n"))
+	}
+
+	pad := make([]byte, 68-len(signature))
+	return append(signature, pad...), nil
+}
+
+/*
+ * Counts the bytes written through it.
+ */
+type countingWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.count += n
+	return n, err
+}
+
+/*
+ * Makes Generate() extract the app binary directly from the app's ELF file,
+ * rather than reading the .bin produced by objcopy.
+ */
+func (image *Image) SetFromElf(fromElf bool) {
+	image.fromElf = fromElf
+}
+
 func (image *Image) Generate() error {
+	if image.fromElf {
+		bin, err := ElfToBin(image.sourceElf)
+		if err != nil {
+			return err
+		}
+		return image.generateFile(bytes.NewReader(bin), int64(len(bin)))
+	}
+
 	binFile, err := os.Open(image.sourceBin)
 	if err != nil {
 		return util.NewNewtError(fmt.Sprintf("Can't open app binary: %s",
@@ -260,18 +808,189 @@ func (image *Image) Generate() error {
 			image.sourceBin, err.Error()))
 	}
 
-	imgFile, err := os.OpenFile(image.targetImg,
-		os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0777)
+	return image.generateFile(binFile, binInfo.Size())
+}
+
+/*
+ * Makes Generate() build the image a second time from the same inputs and
+ * fail if the two results differ.  Signatures are ignored in the
+ * comparison, as they are not deterministic.
+ */
+func (image *Image) SetCheckReproducible(check bool) {
+	image.checkRepro = check
+}
+
+/*
+ * Regenerates the image from the given app binary and compares the result
+ * with the already generated image.
+ */
+func (image *Image) checkReproducible(bin []byte, imgData []byte) error {
+	/* Use a copy so the state of the first build is kept. */
+	dup := *image
+	buf := &bytes.Buffer{}
+	err := dup.GenerateFrom(bytes.NewReader(bin), int64(len(bin)), buf)
 	if err != nil {
-		return util.NewNewtError(fmt.Sprintf("Can't open target image %s: %s",
-			image.targetImg, err.Error()))
+		return err
+	}
+
+	images := []*ParsedImage{}
+	for _, data := range [][]byte{imgData, buf.Bytes()} {
+		pi, err := ReadImage(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		images = append(images, pi)
+	}
+
+	first := images[0].Canonicalize()
+	second := images[1].Canonicalize()
+	if !bytes.Equal(first, second) {
+		off := 0
+		for off < len(first) && off < len(second) &&
+			first[off] == second[off] {
+
+			off++
+		}
+		return util.NewNewtError(fmt.Sprintf("Image is not reproducible; "+
+			"builds differ at offset 0x%x (sizes %d and %d)", off,
+			len(first), len(second)))
+	}
+
+	return nil
+}
+
+func (image *Image) generateFile(bin io.Reader, binSize int64) error {
+	/*
+	 * The sidecar is named .sha256; don't put another digest in it.  Check
+	 * before anything is written.
+	 */
+	if image.sidecar == SIDECAR_IMAGE_HASH &&
+		image.hashAlgorithm().TlvType != IMAGE_TLV_SHA256 {
+
+		return util.NewNewtError(fmt.Sprintf("Cannot write image hash "+
+			"sidecar %s.sha256 for image hashed with %s", image.targetImg,
+			image.hashAlgorithm().Name))
+	}
+
+	var binData []byte
+	if image.checkRepro {
+		binData = make([]byte, binSize)
+		if _, err := io.ReadFull(bin, binData); err != nil {
+			return util.NewNewtError(fmt.Sprintf("Failed to read app "+
+				"binary: %s", err.Error()))
+		}
+		bin = bytes.NewReader(binData)
+	}
+
+	/*
+	 * Write to a temporary file and only move it into place once the image
+	 * is complete, so a failure never leaves a partial image behind.  The
+	 * name is unique so that concurrent builds of the same target don't
+	 * write to the same file.  TempFile creates the file 0600; give it the
+	 * permissions the image has always had with the usual umask.
+	 */
+	imgFile, err := ioutil.TempFile(filepath.Dir(image.targetImg),
+		filepath.Base(image.targetImg)+".tmp")
+	if err != nil {
+		return util.NewNewtError(fmt.Sprintf("Can't create temporary file "+
+			"for target image %s: %s", image.targetImg, err.Error()))
+	}
+	tmpPath := imgFile.Name()
+
+	if err = imgFile.Chmod(0755); err != nil {
+		err = util.NewNewtError(fmt.Sprintf("Can't set permissions of %s: %s",
+			tmpPath, err.Error()))
+	} else {
+		err = image.GenerateFrom(bin, binSize, imgFile)
+	}
+	if closeErr := imgFile.Close(); err == nil && closeErr != nil {
+		err = util.NewNewtError(fmt.Sprintf("Can't write target image "+
+			"%s: %s", tmpPath, closeErr.Error()))
+	}
+
+	if err == nil && image.checkRepro {
+		var imgData []byte
+		imgData, err = ioutil.ReadFile(tmpPath)
+		if err != nil {
+			err = util.NewNewtError(fmt.Sprintf("Can't read image %s: %s",
+				tmpPath, err.Error()))
+		} else {
+			err = image.checkReproducible(binData, imgData)
+		}
+	}
+
+	if err == nil {
+		err = os.Rename(tmpPath, image.targetImg)
+		if err != nil {
+			err = util.NewNewtError(fmt.Sprintf("Can't rename %s to %s: %s",
+				tmpPath, image.targetImg, err.Error()))
+		}
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return image.writeSidecar()
+}
+
+/*
+ * Builds the image from binSize bytes of app binary read from bin, and
+ * writes it to w.  Generate() does the same with the builder's files; this
+ * allows images to be produced from in-memory or other non-file sources.
+ */
+func (image *Image) GenerateFrom(bin io.Reader, binSize int64,
+	w io.Writer) error {
+
+	if pad := image.bodyPad(binSize); pad != 0 {
+		bin = io.MultiReader(bin, bytes.NewReader(make([]byte, pad)))
+		binSize += pad
+	}
+
+	wide := image.wideHdr || binSize > math.MaxUint32
+
+	/*
+	 * The Merkle root depends on this body, so it is built per generate
+	 * rather than stored with the image's other informational TLVs.
+	 */
+	infoTlvs := image.infoTlvs
+	if image.merkleChunk != 0 {
+		body := make([]byte, binSize)
+		if _, err := io.ReadFull(bin, body); err != nil {
+			return util.NewNewtError(fmt.Sprintf("Failed to read app "+
+				"binary: %s", err.Error()))
+		}
+		data, err := merkleTlvData(body, image.merkleChunk)
+		if err != nil {
+			return err
+		}
+		infoTlvs = append(infoTlvs[:len(infoTlvs):len(infoTlvs)],
+			infoTlv{IMAGE_TLV_MERKLE, data})
+		bin = bytes.NewReader(body)
 	}
-	defer imgFile.Close()
+
+	image.tlvs = nil
+
+	/*
+	 * Keep track of the size and checksums of everything written.
+	 */
+	fileCrc := crc32.NewIEEE()
+	fileHash := sha256.New()
+	out := &countingWriter{w: io.MultiWriter(w, fileCrc, fileHash)}
 
 	/*
 	 * Compute hash while updating the file.
 	 */
-	hash := sha256.New()
+	hashAlg := image.hashAlgorithm()
+	if hashAlg.TlvType != IMAGE_TLV_SHA256 &&
+		(image.signingRSA != nil || image.signingEC != nil) {
+
+		return util.NewNewtError(fmt.Sprintf("Cannot sign image hashed "+
+			"with %s; signatures require %s", hashAlg.Name,
+			HASH_ALG_SHA256))
+	}
+	hash := hashAlg.New()
+	hashStart := time.Now()
 
 	/*
 	 * First the header
@@ -283,166 +1002,316 @@ func (image *Image) Generate() error {
 		Pad1:  0,
 		HdrSz: IMAGE_HEADER_SIZE,
 		Pad2:  0,
-		ImgSz: uint32(binInfo.Size()),
+		ImgSz: 0,
 		Flags: 0,
 		Vers:  image.version,
 		Pad3:  0,
 	}
+	hdr.TlvSz = image.tlvFootprint(hash.Size())
+	hdr.Flags = hashAlg.Flag
+
+	/*
+	 * An image can carry both an RSA and an EC signature.
+	 */
 	if image.signingRSA != nil {
-		hdr.TlvSz = 4 + 256 + 4 + 32
-		hdr.Flags = IMAGE_F_PKCS15_RSA2048_SHA256 | IMAGE_F_SHA256
+		err := checkRsaKeySize(image.signingRSA)
+		if err != nil {
+			return err
+		}
+		hdr.TlvSz += image.tlvFootprint(RSA2048_SIG_LEN)
+		hdr.Flags |= IMAGE_F_PKCS15_RSA2048_SHA256
 		hdr.KeyId = image.keyId
-	} else if image.signingEC != nil {
-		hdr.TlvSz = 4 + 68 + 4 + 32
-		hdr.Flags = IMAGE_F_ECDSA224_SHA256 | IMAGE_F_SHA256
+	}
+	if image.signingEC != nil {
+		hdr.TlvSz += image.tlvFootprint(68)
+		hdr.Flags |= IMAGE_F_ECDSA224_SHA256
+		if image.signingRSA == nil {
+			hdr.KeyId = image.ecKeyId
+		}
+	}
+	for _, info := range infoTlvs {
+		hdr.TlvSz += image.tlvFootprint(len(info.data))
+	}
+
+	var hdrData interface{} = hdr
+	if wide {
+		hdrData = wideImageHdr(hdr, uint64(binSize))
 	} else {
-		hdr.TlvSz = 4 + 32
-		hdr.Flags = IMAGE_F_SHA256
+		hdr.ImgSz = uint32(binSize)
 	}
 
-	err = binary.Write(imgFile, binary.LittleEndian, hdr)
+	err := binary.Write(out, binary.LittleEndian, hdrData)
 	if err != nil {
 		return util.NewNewtError(fmt.Sprintf("Failed to serialize image hdr: %s",
 			err.Error()))
 	}
-	err = binary.Write(hash, binary.LittleEndian, hdr)
-	if err != nil {
-		return util.NewNewtError(fmt.Sprintf("Failed to hash data: %s",
-			err.Error()))
+	if image.hashScope == HASH_SCOPE_HDR_BODY {
+		err = binary.Write(hash, binary.LittleEndian, hdrData)
+		if err != nil {
+			return util.NewNewtError(fmt.Sprintf("Failed to hash data: %s",
+				err.Error()))
+		}
 	}
 
 	/*
 	 * Followed by data.
 	 */
-	dataBuf := make([]byte, 1024)
-	for {
-		cnt, err := binFile.Read(dataBuf)
-		if err != nil && err != io.EOF {
-			return util.NewNewtError(fmt.Sprintf("Failed to read from %s: %s",
-				image.sourceBin, err.Error()))
-		}
-		if cnt == 0 {
-			break
-		}
-		_, err = imgFile.Write(dataBuf[0:cnt])
-		if err != nil {
-			return util.NewNewtError(fmt.Sprintf("Failed to write to %s: %s",
-				image.targetImg, err.Error()))
-		}
-		_, err = hash.Write(dataBuf[0:cnt])
-		if err != nil {
-			return util.NewNewtError(fmt.Sprintf("Failed to hash data: %s",
-				err.Error()))
-		}
+	_, err = io.CopyN(io.MultiWriter(out, hash), bin, binSize)
+	if err != nil {
+		return util.NewNewtError(fmt.Sprintf("Failed to copy app binary: "+
+			"%s", err.Error()))
 	}
 
 	image.hash = hash.Sum(nil)
+	util.StatusMessage(util.VERBOSITY_VERBOSE,
+		"Image hash computed in %s\n", time.Since(hashStart))
 
 	/*
 	 * Trailer with hash of the data
 	 */
-	tlv := &ImageTrailerTlv{
-		Type: IMAGE_TLV_SHA256,
-		Pad:  0,
-		Len:  uint16(len(image.hash)),
-	}
-	err = binary.Write(imgFile, binary.LittleEndian, tlv)
+	err = image.writeTlv(out, hashAlg.TlvType, image.hash)
 	if err != nil {
-		return util.NewNewtError(fmt.Sprintf("Failed to serialize image "+
-			"trailer: %s", err.Error()))
-	}
-	_, err = imgFile.Write(image.hash)
-	if err != nil {
-		return util.NewNewtError(fmt.Sprintf("Failed to append hash: %s",
-			err.Error()))
+		return err
 	}
 
 	if image.signingRSA != nil {
 		/*
 		 * If signing key was set, generate TLV for that.
 		 */
-		tlv := &ImageTrailerTlv{
-			Type: IMAGE_TLV_RSA2048,
-			Pad:  0,
-			Len:  256, /* 2048 bits */
-		}
-		signature, err := rsa.SignPKCS1v15(rand.Reader, image.signingRSA,
-			crypto.SHA256, image.hash)
+		signStart := time.Now()
+		signature, err := signRsa(image.signingRSA, image.hash)
 		if err != nil {
-			return util.NewNewtError(fmt.Sprintf(
-				"Failed to compute signature: %s", err))
+			return err
 		}
+		util.StatusMessage(util.VERBOSITY_VERBOSE,
+			"RSA signature computed in %s\n", time.Since(signStart))
 
-		err = binary.Write(imgFile, binary.LittleEndian, tlv)
+		err = image.writeTlv(out, IMAGE_TLV_RSA2048, signature)
 		if err != nil {
-			return util.NewNewtError(fmt.Sprintf("Failed to serialize image "+
-				"trailer: %s", err.Error()))
-		}
-		_, err = imgFile.Write(signature)
-		if err != nil {
-			return util.NewNewtError(fmt.Sprintf("Failed to append sig: %s",
-				err.Error()))
+			return err
 		}
 	}
 	if image.signingEC != nil {
-		r, s, err := ecdsa.Sign(rand.Reader, image.signingEC, image.hash)
+		signStart := time.Now()
+		signature, err := signEc(image.signingEC, image.hash)
 		if err != nil {
-			return util.NewNewtError(fmt.Sprintf(
-				"Failed to compute signature: %s", err))
+			return err
 		}
+		util.StatusMessage(util.VERBOSITY_VERBOSE,
+			"ECDSA signature computed in %s\n", time.Since(signStart))
 
-		var ECDSA ECDSASig
-		ECDSA.R = r
-		ECDSA.S = s
-		signature, err := asn1.Marshal(ECDSA)
+		err = image.writeTlv(out, IMAGE_TLV_ECDSA224, signature)
 		if err != nil {
-			return util.NewNewtError(fmt.Sprintf(
-				"Failed to construct signature: %s", err))
+			return err
 		}
-		if len(signature) > 68 {
-			return util.NewNewtError(fmt.Sprintf(
-				"Something is really wrong\n"))
-		}
-		tlv := &ImageTrailerTlv{
-			Type: IMAGE_TLV_ECDSA224,
-			Pad:  0,
-			Len:  68,
-		}
-		err = binary.Write(imgFile, binary.LittleEndian, tlv)
-		if err != nil {
-			return util.NewNewtError(fmt.Sprintf("Failed to serialize image "+
-				"trailer: %s", err.Error()))
-		}
-		_, err = imgFile.Write(signature)
+	}
+
+	/*
+	 * Informational TLVs go after the signature.
+	 */
+	for _, info := range infoTlvs {
+		err = image.writeTlv(out, info.tlvType, info.data)
 		if err != nil {
-			return util.NewNewtError(fmt.Sprintf("Failed to append sig: %s",
-				err.Error()))
+			return err
 		}
-		pad := make([]byte, 68-len(signature))
-		_, err = imgFile.Write(pad)
+	}
+
+	/*
+	 * The TLV size in the header was computed up front; make sure it
+	 * describes what was actually written.
+	 */
+	trailerSz := out.count - int(hdr.HdrSz) - int(binSize)
+	if trailerSz != int(hdr.TlvSz) {
+		return util.NewNewtError(fmt.Sprintf("Image trailer size mismatch; "+
+			"hdr=%d actual=%d", hdr.TlvSz, trailerSz))
+	}
+
+	image.totalSize = out.count
+	image.fileCrc = fileCrc.Sum32()
+	image.fileHash = fileHash.Sum(nil)
+
+	return nil
+}
+
+/*
+ * Enables recording a CRC32 (IEEE) of the complete .img file in the build
+ * manifest.  The CRC is not stored in the image itself; it is always
+ * available from FileCrc() after the image is generated.
+ */
+func (image *Image) SetFileCrc(enable bool) {
+	image.useFileCrc = enable
+}
+
+func (image *Image) FileCrc() uint32 {
+	return image.fileCrc
+}
+
+/*
+ * Selects whether Generate() also writes <image>.sha256, and which hash it
+ * contains.  The file holds the hex encoded hash followed by a newline.
+ * SIDECAR_IMAGE_HASH requires an image hashed with HASH_ALG_SHA256;
+ * Generate() fails otherwise.
+ */
+func (image *Image) SetSha256Sidecar(mode int) {
+	image.sidecar = mode
+}
+
+func (image *Image) writeSidecar() error {
+	var hash []byte
+
+	switch image.sidecar {
+	case SIDECAR_NONE:
+		return nil
+	case SIDECAR_IMAGE_HASH:
+		hash = image.hash
+	case SIDECAR_FILE_HASH:
+		hash = image.fileHash
+	default:
+		return util.NewNewtError(fmt.Sprintf("Invalid sidecar mode %d",
+			image.sidecar))
+	}
+
+	err := ioutil.WriteFile(image.targetImg+".sha256",
+		[]byte(fmt.Sprintf("%x\n", hash)), 0666)
+	if err != nil {
+		return util.NewNewtError(fmt.Sprintf("Can't write %s.sha256: %s",
+			image.targetImg, err.Error()))
+	}
+
+	return nil
+}
+
+/*
+ * Describes the TLVs written to the image trailer.  Must be called after
+ * Generate(); see ParsedImage.DescribeTlvs() for images already built.
+ */
+func (image *Image) DescribeTlvs() []TlvDescription {
+	pi := &ParsedImage{HashScope: image.hashScope}
+	for _, tlv := range image.tlvs {
+		pi.Tlvs = append(pi.Tlvs, ParsedTlv{Hdr: tlv})
+	}
+
+	return pi.DescribeTlvs()
+}
+
+/*
+ * Signature TLV data lengths, keyed by algorithm name.
+ */
+var sigAlgTlvLens = map[string]int{
+	"RSA2048":  RSA2048_SIG_LEN,
+	"ECDSA224": 68,
+}
+
+/*
+ * Size of the app binary the image will be generated from.
+ */
+func (image *Image) binSize() (int, error) {
+	if image.fromElf {
+		bin, err := ElfToBin(image.sourceElf)
 		if err != nil {
-			return util.NewNewtError(fmt.Sprintf("Failed to serialize image "+
-				"trailer: %s", err.Error()))
+			return 0, err
 		}
+		return len(bin), nil
+	}
+
+	binInfo, err := os.Stat(image.sourceBin)
+	if err != nil {
+		return 0, util.NewNewtError(fmt.Sprintf("Can't stat app binary "+
+			"%s: %s", image.sourceBin, err.Error()))
+	}
+	return int(binInfo.Size()), nil
+}
+
+/*
+ * Computes the size the image will have once signed with the named
+ * algorithm ("RSA2048" or "ECDSA224"), without signing it.  This lets the
+ * slot budget be checked before the image is sent off for external
+ * signing.  Signatures for keys already configured on the image are
+ * counted as well; each algorithm is counted once, as an image carries at
+ * most one signature of each kind.
+ */
+func (image *Image) EstimateSignedSize(sigAlg string) (int, error) {
+	sigLen, ok := sigAlgTlvLens[sigAlg]
+	if !ok {
+		return 0, util.NewNewtError(fmt.Sprintf("Unknown signature "+
+			"algorithm \"%s\"", sigAlg))
+	}
+
+	size, err := image.binSize()
+	if err != nil {
+		return 0, err
+	}
+
+	size += IMAGE_HEADER_SIZE + int(image.bodyPad(int64(size)))
+	size += int(image.tlvFootprint(image.hashAlgorithm().New().Size()))
+
+	sigLens := map[string]int{sigAlg: sigLen}
+	if image.signingRSA != nil {
+		sigLens["RSA2048"] = RSA2048_SIG_LEN
+	}
+	if image.signingEC != nil {
+		sigLens["ECDSA224"] = 68
+	}
+	for _, l := range sigLens {
+		size += int(image.tlvFootprint(l))
+	}
+
+	for _, info := range image.infoTlvs {
+		size += int(image.tlvFootprint(len(info.data)))
+	}
+	if image.merkleChunk != 0 {
+		size += int(image.tlvFootprint(MERKLE_TLV_LEN))
+	}
+
+	return size, nil
+}
+
+/*
+ * Checks whether the generated image can be written to a flash slot
+ * starting at the given base address.  Must be called after Generate().
+ */
+func (image *Image) CanFlashAt(base int, slotSize int, sectorSize int) error {
+	if image.totalSize == 0 {
+		return util.NewNewtError("Image has not been generated")
+	}
+	if sectorSize <= 0 {
+		return util.NewNewtError(fmt.Sprintf("Invalid sector size %d",
+			sectorSize))
+	}
+	if base%sectorSize != 0 {
+		return util.NewNewtError(fmt.Sprintf("Image header at 0x%x is not "+
+			"on a sector boundary (sector size %d)", base, sectorSize))
+	}
+	if (base+IMAGE_HEADER_SIZE)%4 != 0 {
+		return util.NewNewtError(fmt.Sprintf("Image body at 0x%x is not "+
+			"word aligned", base+IMAGE_HEADER_SIZE))
+	}
+	if image.totalSize > slotSize {
+		return util.NewNewtError(fmt.Sprintf("Image too large for slot; "+
+			"image=%d slot=%d", image.totalSize, slotSize))
 	}
 
 	return nil
 }
 
 func (image *Image) CreateManifest(t *target.Target) error {
-	versionStr := fmt.Sprintf("%d.%d.%d.%d",
-		image.version.Major, image.version.Minor,
-		image.version.Rev, image.version.BuildNum)
+	versionStr := image.version.String()
 	hashStr := fmt.Sprintf("%x", image.hash)
 	timeStr := time.Now().Format(time.RFC3339)
 
 	manifest := &ImageManifest{
 		Version: versionStr,
 		Hash:    hashStr,
+		VcsHash: image.vcsHash,
+		Size:    image.totalSize,
 		Image:   filepath.Base(image.targetImg),
 		Date:    timeStr,
 	}
 
+	if image.useFileCrc {
+		manifest.FileCrc = fmt.Sprintf("%08x", image.fileCrc)
+	}
+
 	for _, builtPkg := range image.builder.Packages {
 		imgPkg := &ImageManifestPkg{
 			Name: builtPkg.Name(),
@@ -0,0 +1,370 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRsaKeySize(t *testing.T) {
+	for _, bits := range []int{1024, 3072} {
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		image := newTestImage(t, "1.0.0")
+		if err := image.SetSigningPrivateKey(key, 0); err == nil {
+			t.Errorf("%d-bit RSA key accepted", bits)
+		}
+	}
+
+	image := newTestImage(t, "1.0.0")
+	rsaKey, _ := testKeys(t)
+	if err := image.SetSigningPrivateKey(rsaKey, 0); err != nil {
+		t.Fatal(err)
+	}
+	_, pi := generateTestImage(t, image, testBody(100))
+	if err := pi.VerifyStructure(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(pi.FindTlv(IMAGE_TLV_RSA2048).Data); n != RSA2048_SIG_LEN {
+		t.Fatalf("RSA2048 TLV length %d", n)
+	}
+}
+
+func TestVerifyStructureRsaLength(t *testing.T) {
+	rsaKey, _ := testKeys(t)
+	image := newTestImage(t, "1.0.0")
+	image.SetSigningPrivateKey(rsaKey, 0)
+	_, pi := generateTestImage(t, image, testBody(100))
+
+	/* A signature made with a larger key must not pass as RSA2048. */
+	tlv := pi.FindTlv(IMAGE_TLV_RSA2048)
+	tlv.Data = make([]byte, 512)
+	tlv.Hdr.Len = 512
+	pi.Hdr.TlvSz += 256
+	if err := pi.VerifyStructure(); err == nil {
+		t.Fatal("512-byte RSA2048 signature accepted")
+	}
+}
+
+func TestTlvAlign(t *testing.T) {
+	_, ecKey := testKeys(t)
+	image := newTestImage(t, "1.0.0")
+	if err := image.SetTlvAlign(8); err != nil {
+		t.Fatal(err)
+	}
+	image.SetSigningPrivateKey(ecKey, 0)
+
+	/* An odd body size leaves the trailer unaligned unless padded. */
+	_, pi := generateTestImage(t, image, testBody(101))
+	if err := pi.CheckTlvAlignment(8); err != nil {
+		t.Fatal(err)
+	}
+	if err := pi.VerifyStructure(); err != nil {
+		t.Fatal(err)
+	}
+	if pi.TlvAlign < 8 {
+		t.Fatalf("inferred TLV alignment %d", pi.TlvAlign)
+	}
+
+	err := pi.ReplaceBody(testBody(203), []crypto.PrivateKey{ecKey}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pi.CheckTlvAlignment(8); err != nil {
+		t.Fatal(err)
+	}
+	if err := pi.VerifyHash(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pi.VerifySig(ecKey.Public()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyId(t *testing.T) {
+	rsaKey, ecKey := testKeys(t)
+
+	/* Adding an EC key after the RSA key must not change the key ID. */
+	image := newTestImage(t, "1.0.0")
+	image.SetSigningPrivateKey(rsaKey, 3)
+	image.SetSigningPrivateKey(ecKey, 9)
+	_, pi := generateTestImage(t, image, testBody(10))
+	if pi.Hdr.KeyId != 3 {
+		t.Errorf("key ID %d; expected 3", pi.Hdr.KeyId)
+	}
+
+	/* Without an RSA key, the header carries the EC key's ID. */
+	image = newTestImage(t, "1.0.0")
+	image.SetSigningPrivateKey(ecKey, 9)
+	_, pi = generateTestImage(t, image, testBody(10))
+	if pi.Hdr.KeyId != 9 {
+		t.Errorf("EC-only key ID %d; expected 9", pi.Hdr.KeyId)
+	}
+}
+
+func TestReplaceBodyKeyId(t *testing.T) {
+	rsaKey, _ := testKeys(t)
+
+	/* Signing a previously unsigned image must record the key ID. */
+	_, pi := generateTestImage(t, newTestImage(t, "1.0.0"), testBody(10))
+	err := pi.ReplaceBody(testBody(20), []crypto.PrivateKey{rsaKey}, 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi.Hdr.KeyId != 5 {
+		t.Errorf("key ID %d; expected 5", pi.Hdr.KeyId)
+	}
+	if err := pi.VerifySig(rsaKey.Public()); err != nil {
+		t.Fatal(err)
+	}
+
+	/* Dropping the signatures must clear it again. */
+	if err := pi.ReplaceBody(testBody(20), nil, 5, 0); err != nil {
+		t.Fatal(err)
+	}
+	if pi.Hdr.KeyId != 0 {
+		t.Errorf("unsigned key ID %d; expected 0", pi.Hdr.KeyId)
+	}
+}
+
+func TestGenerateConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	binPath := filepath.Join(dir, "app.bin")
+	imgPath := filepath.Join(dir, "app.img")
+	if err := ioutil.WriteFile(binPath, testBody(5000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	/* Two builds of the same target must not share a temporary file. */
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, _ := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			image := newTestImage(t, "1.0.0")
+			image.sourceBin = binPath
+			image.targetImg = imgPath
+			errs[i] = image.Generate()
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pi, err := ReadImageFile(imgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pi.VerifyHash(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("%d files left in output directory; expected 2",
+			len(entries))
+	}
+}
+
+func TestOversizedBinary(t *testing.T) {
+	/*
+	 * Simulate a binary too large for the 32-bit size field.  The reader
+	 * runs dry long before then, but the header is written first, and it
+	 * must use the 64-bit size rather than a wrapped 32-bit one.
+	 */
+	const binSize = math.MaxUint32 + 100
+	buf := &bytes.Buffer{}
+	err := newTestImage(t, "1.0.0").GenerateFrom(strings.NewReader("x"),
+		binSize, buf)
+	if err == nil {
+		t.Fatal("short app binary accepted")
+	}
+
+	hdr := ImageHdr64{}
+	if err := binary.Read(buf, binary.LittleEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Magic != IMAGE_MAGIC_64 || hdr.ImgSz != binSize {
+		t.Fatalf("header magic=0x%08x size=%d", hdr.Magic, hdr.ImgSz)
+	}
+}
+
+func TestImageLayout(t *testing.T) {
+	/*
+	 * Build the expected bytes of an unsigned image by hand: header, body,
+	 * then a trailer holding one SHA256 TLV over header+body.  TlvSz
+	 * counts the trailer bytes, TLV headers included.
+	 */
+	body := testBody(100)
+	hdr := ImageHdr{
+		Magic: IMAGE_MAGIC,
+		TlvSz: 4 + 32,
+		HdrSz: IMAGE_HEADER_SIZE,
+		ImgSz: uint32(len(body)),
+		Flags: IMAGE_F_SHA256,
+		Vers:  ImageVersion{1, 2, 3, 4},
+	}
+	want := &bytes.Buffer{}
+	binary.Write(want, binary.LittleEndian, &hdr)
+	want.Write(body)
+	hash := sha256.Sum256(want.Bytes())
+	want.Write([]byte{IMAGE_TLV_SHA256, 0, 32, 0})
+	want.Write(hash[:])
+
+	data, _ := generateTestImage(t, newTestImage(t, "1.2.3.4"), body)
+	if !bytes.Equal(data, want.Bytes()) {
+		t.Fatalf("image layout differs:\nhave %x\nwant %x", data,
+			want.Bytes())
+	}
+}
+
+func TestTlvSzMatchesTrailer(t *testing.T) {
+	rsaKey, ecKey := testKeys(t)
+	image := newTestImage(t, "1.0.0")
+	image.SetSigningPrivateKey(rsaKey, 0)
+	image.SetSigningPrivateKey(ecKey, 0)
+	image.SetVcsHash("1f2e3d4c")
+	data, pi := generateTestImage(t, image, testBody(100))
+
+	trailerSz := len(data) - IMAGE_HEADER_SIZE - 100
+	if int(pi.Hdr.TlvSz) != trailerSz {
+		t.Fatalf("TlvSz %d; trailer is %d bytes", pi.Hdr.TlvSz, trailerSz)
+	}
+
+	/* A TlvSz that disagrees with the trailer must not parse. */
+	for _, delta := range []int{-1, 1} {
+		bad := append([]byte{}, data...)
+		binary.LittleEndian.PutUint16(bad[4:], uint16(trailerSz+delta))
+		if _, err := ReadImage(bytes.NewReader(bad)); err == nil {
+			t.Errorf("TlvSz off by %d accepted", delta)
+		}
+	}
+}
+
+func TestMerkleTlvPerGenerate(t *testing.T) {
+	image := newTestImage(t, "1.0.0")
+	if err := image.SetMerkleChunkSize(64); err != nil {
+		t.Fatal(err)
+	}
+
+	/* Each generate must carry the root of its own body. */
+	for _, n := range []int{100, 300} {
+		body := testBody(n)
+		_, pi := generateTestImage(t, image, body)
+		chunkSize, root, err := pi.MerkleRoot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := MerkleRoot(body, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chunkSize != 64 || !bytes.Equal(root, want) {
+			t.Errorf("%d-byte body: Merkle TLV (%d, %x); want (64, %x)",
+				n, chunkSize, root, want)
+		}
+	}
+
+	/* Disabling the TLV must drop it from the next generate. */
+	image.SetMerkleChunkSize(0)
+	_, pi := generateTestImage(t, image, testBody(100))
+	if pi.FindTlv(IMAGE_TLV_MERKLE) != nil {
+		t.Errorf("Merkle TLV present after SetMerkleChunkSize(0)")
+	}
+}
+
+func TestEstimateSignedSize(t *testing.T) {
+	rsaKey, ecKey := testKeys(t)
+
+	dir, err := ioutil.TempDir("", "image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binPath := filepath.Join(dir, "app.bin")
+	body := testBody(1000)
+	if err := ioutil.WriteFile(binPath, body, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rsa    bool
+		ec     bool
+		sigAlg string
+	}{
+		{false, false, "RSA2048"},
+		{false, false, "ECDSA224"},
+		{true, false, "RSA2048"},
+		{false, true, "ECDSA224"},
+		{false, true, "RSA2048"},
+		{true, true, "ECDSA224"},
+	}
+	for _, test := range tests {
+		/* Estimate with the configured keys. */
+		image := newTestImage(t, "1.0.0")
+		image.sourceBin = binPath
+		if test.rsa {
+			image.SetSigningPrivateKey(rsaKey, 0)
+		}
+		if test.ec {
+			image.SetSigningPrivateKey(ecKey, 0)
+		}
+		estimate, err := image.EstimateSignedSize(test.sigAlg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		/* Then actually sign with those keys plus the named algorithm. */
+		if test.sigAlg == "RSA2048" {
+			image.SetSigningPrivateKey(rsaKey, 0)
+		} else {
+			image.SetSigningPrivateKey(ecKey, 0)
+		}
+		data, _ := generateTestImage(t, image, body)
+
+		if estimate != len(data) {
+			t.Errorf("%+v: estimated %d bytes; image is %d", test,
+				estimate, len(data))
+		}
+	}
+}
@@ -0,0 +1,224 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"mynewt.apache.org/newt/util"
+)
+
+/*
+ * Manifest covering every image flashed to a device (e.g., bootloader,
+ * loader and app).
+ */
+type SetManifest struct {
+	Images []*SetManifestImage `json:"images"`
+	Hash   string              `json:"id"` /* SHA256 of encoded images */
+}
+
+type SetManifestImage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Hash    string `json:"hash"`
+	Size    int    `json:"size"`
+	SigAlg  string `json:"sig_alg"`
+}
+
+func GenerateSetManifest(images []*ParsedImage,
+	names []string) (*SetManifest, error) {
+
+	if len(images) != len(names) {
+		return nil, util.NewNewtError(fmt.Sprintf("Image count (%d) does "+
+			"not match name count (%d)", len(images), len(names)))
+	}
+
+	manifest := &SetManifest{}
+	for i, pi := range images {
+		hash, err := pi.HashTlv()
+		if err != nil {
+			return nil, util.NewNewtError(fmt.Sprintf("Image %s: %s",
+				names[i], err.(*util.NewtError).Text))
+		}
+
+		manifest.Images = append(manifest.Images, &SetManifestImage{
+			Name:    names[i],
+			Version: pi.Hdr.Vers.String(),
+			Hash:    fmt.Sprintf("%x", hash.Data),
+			Size:    pi.TotalSize(),
+			SigAlg:  pi.SigAlg(),
+		})
+	}
+
+	buffer, err := json.Marshal(manifest.Images)
+	if err != nil {
+		return nil, util.NewNewtError(fmt.Sprintf("Cannot encode "+
+			"manifest: %s", err.Error()))
+	}
+	manifest.Hash = fmt.Sprintf("%x", sha256.Sum256(buffer))
+
+	return manifest, nil
+}
+
+/*
+ * Detached signature over an image manifest.
+ */
+type ManifestSig struct {
+	KeyId string `json:"key_id"` /* SHA256 of the DER public key */
+	Alg   string `json:"alg"`
+	Sig   string `json:"sig"`
+}
+
+/*
+ * Returns the hex SHA256 fingerprint of a public key's PKIX encoding.
+ */
+func KeyFingerprint(pubKey crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return "", util.NewNewtError(fmt.Sprintf("Cannot encode public "+
+			"key: %s", err.Error()))
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(der)), nil
+}
+
+/*
+ * The bytes covered by a manifest signature.  Only fields describing the
+ * image itself are included, so build time and package lists can change
+ * without invalidating the signature.
+ */
+func manifestSigHash(manifest *ImageManifest, keyId string) ([]byte, error) {
+	signed := struct {
+		Version string `json:"version"`
+		Hash    string `json:"hash"`
+		Size    int    `json:"size"`
+		KeyId   string `json:"key_id"`
+	}{
+		Version: manifest.Version,
+		Hash:    manifest.Hash,
+		Size:    manifest.Size,
+		KeyId:   keyId,
+	}
+
+	buffer, err := json.Marshal(signed)
+	if err != nil {
+		return nil, util.NewNewtError(fmt.Sprintf("Cannot encode "+
+			"manifest: %s", err.Error()))
+	}
+	hash := sha256.Sum256(buffer)
+	return hash[:], nil
+}
+
+/*
+ * Signs the version, hash and size recorded in an image manifest with an
+ * RSA or EC private key.
+ */
+func SignManifest(manifest *ImageManifest,
+	key crypto.PrivateKey) (*ManifestSig, error) {
+
+	var pubKey crypto.PublicKey
+	var alg uint8
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		pubKey = &k.PublicKey
+		alg = IMAGE_TLV_RSA2048
+	case *ecdsa.PrivateKey:
+		pubKey = &k.PublicKey
+		alg = IMAGE_TLV_ECDSA224
+	default:
+		return nil, util.NewNewtError(fmt.Sprintf("Unsupported key type "+
+			"%T", key))
+	}
+
+	keyId, err := KeyFingerprint(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := manifestSigHash(manifest, keyId)
+	if err != nil {
+		return nil, err
+	}
+
+	/*
+	 * Unlike the image TLV, a manifest signature has no fixed size, so EC
+	 * signatures are plain DER and keys on any curve can be used.
+	 */
+	var sig []byte
+	if alg == IMAGE_TLV_RSA2048 {
+		sig, err = signRsa(key.(*rsa.PrivateKey), hash)
+	} else {
+		sig, err = signEcDer(key.(*ecdsa.PrivateKey), hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &ManifestSig{
+		KeyId: keyId,
+		Alg:   TlvTypeName(alg),
+		Sig:   hex.EncodeToString(sig),
+	}, nil
+}
+
+/*
+ * Checks a signature produced by SignManifest() against the manifest and
+ * the given public key.
+ */
+func VerifyManifestSig(manifest *ImageManifest, ms *ManifestSig,
+	pubKey crypto.PublicKey) error {
+
+	keyId, err := KeyFingerprint(pubKey)
+	if err != nil {
+		return err
+	}
+	if keyId != ms.KeyId {
+		return util.NewNewtError(fmt.Sprintf("Manifest signed by key %s, "+
+			"not %s", ms.KeyId, keyId))
+	}
+
+	tlv := &ParsedTlv{}
+	switch ms.Alg {
+	case TlvTypeName(IMAGE_TLV_RSA2048):
+		tlv.Hdr.Type = IMAGE_TLV_RSA2048
+	case TlvTypeName(IMAGE_TLV_ECDSA224):
+		tlv.Hdr.Type = IMAGE_TLV_ECDSA224
+	default:
+		return util.NewNewtError(fmt.Sprintf("Unknown manifest signature "+
+			"algorithm \"%s\"", ms.Alg))
+	}
+	tlv.Data, err = hex.DecodeString(ms.Sig)
+	if err != nil {
+		return util.NewNewtError(fmt.Sprintf("Bad manifest signature: %s",
+			err.Error()))
+	}
+	tlv.Hdr.Len = uint16(len(tlv.Data))
+
+	hash, err := manifestSigHash(manifest, keyId)
+	if err != nil {
+		return err
+	}
+	return verifySigTlv(tlv, hash, pubKey)
+}
@@ -0,0 +1,79 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package image
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/hex"
+	"testing"
+)
+
+func TestSignManifest(t *testing.T) {
+	rsaKey, ecKey := testKeys(t)
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := &ImageManifest{
+		Version: "1.2.3.4",
+		Hash:    "00112233445566778899aabbccddeeff",
+		Size:    1234,
+	}
+
+	/*
+	 * P-256 DER signatures don't fit the 68-byte ECDSA224 TLV; sign
+	 * several times, as the encoded length varies with r and s.
+	 */
+	keys := []crypto.Signer{rsaKey, ecKey}
+	for i := 0; i < 20; i++ {
+		keys = append(keys, p256Key)
+	}
+	for _, key := range keys {
+		ms, err := SignManifest(manifest, key)
+		if err != nil {
+			t.Fatalf("%T: %v", key, err)
+		}
+		if err := VerifyManifestSig(manifest, ms, key.Public()); err != nil {
+			t.Fatalf("%T: %v", key, err)
+		}
+
+		/* EC signatures are plain DER, with no TLV padding. */
+		if _, ok := key.(*ecdsa.PrivateKey); ok {
+			sig, _ := hex.DecodeString(ms.Sig)
+			var ecSig ECDSASig
+			rest, err := asn1.Unmarshal(sig, &ecSig)
+			if err != nil || len(rest) != 0 {
+				t.Fatalf("bad DER signature: err=%v trailing=%d", err,
+					len(rest))
+			}
+		}
+	}
+
+	/* The signature covers the image fields. */
+	ms, _ := SignManifest(manifest, p256Key)
+	manifest.Size++
+	if err := VerifyManifestSig(manifest, ms, p256Key.Public()); err == nil {
+		t.Fatal("modified manifest accepted")
+	}
+}
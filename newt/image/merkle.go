@@ -0,0 +1,190 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"mynewt.apache.org/newt/util"
+)
+
+/*
+ * Merkle tree over fixed-size body chunks.  It allows a device to verify
+ * each chunk of a resumable download as it arrives, using only the root
+ * from the image trailer and a short proof per chunk.
+ *
+ * Leaves are SHA256(0x00 | chunk); interior nodes are
+ * SHA256(0x01 | left | right).  A node without a sibling is promoted to
+ * the next level unchanged.
+ *
+ * Like all trailer TLVs, the root is not covered by the image signature;
+ * the complete image must still be verified once the download finishes.
+ */
+
+const (
+	MERKLE_TLV_LEN = 4 + sha256.Size /* Chunk size + root */
+)
+
+func merkleLeaf(chunk []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	h.Write(chunk)
+	return h.Sum(nil)
+}
+
+func merkleNode(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+func merkleChunkCount(bodyLen int, chunkSize int) int {
+	if bodyLen == 0 {
+		return 1
+	}
+	return (bodyLen + chunkSize - 1) / chunkSize
+}
+
+func merkleLevels(body []byte, chunkSize int) [][][]byte {
+	numChunks := merkleChunkCount(len(body), chunkSize)
+
+	level := make([][]byte, numChunks)
+	for i, _ := range level {
+		end := util.Min((i+1)*chunkSize, len(body))
+		level[i] = merkleLeaf(body[i*chunkSize : end])
+	}
+
+	levels := [][][]byte{level}
+	for len(level) > 1 {
+		next := [][]byte{}
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, merkleNode(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+
+	return levels
+}
+
+func MerkleRoot(body []byte, chunkSize int) ([]byte, error) {
+	if chunkSize <= 0 {
+		return nil, util.NewNewtError(fmt.Sprintf("Invalid Merkle chunk "+
+			"size %d", chunkSize))
+	}
+
+	levels := merkleLevels(body, chunkSize)
+	return levels[len(levels)-1][0], nil
+}
+
+/*
+ * Returns the sibling hashes needed to verify the given chunk against the
+ * root, ordered from the leaf level upwards.
+ */
+func MerkleProof(body []byte, chunkSize int, idx int) ([][]byte, error) {
+	if chunkSize <= 0 {
+		return nil, util.NewNewtError(fmt.Sprintf("Invalid Merkle chunk "+
+			"size %d", chunkSize))
+	}
+	if idx < 0 || idx >= merkleChunkCount(len(body), chunkSize) {
+		return nil, util.NewNewtError(fmt.Sprintf("Invalid Merkle chunk "+
+			"index %d", idx))
+	}
+
+	proof := [][]byte{}
+	levels := merkleLevels(body, chunkSize)
+	for _, level := range levels[:len(levels)-1] {
+		if sib := idx ^ 1; sib < len(level) {
+			proof = append(proof, level[sib])
+		}
+		idx /= 2
+	}
+
+	return proof, nil
+}
+
+/*
+ * Checks a single body chunk against a Merkle root.  numChunks is the total
+ * number of chunks in the body.
+ */
+func VerifyMerkleChunk(root []byte, chunk []byte, idx int, numChunks int,
+	proof [][]byte) bool {
+
+	if idx < 0 || idx >= numChunks {
+		return false
+	}
+
+	hash := merkleLeaf(chunk)
+	levelLen := numChunks
+	for levelLen > 1 {
+		if sib := idx ^ 1; sib < levelLen {
+			if len(proof) == 0 {
+				return false
+			}
+			if idx%2 == 0 {
+				hash = merkleNode(hash, proof[0])
+			} else {
+				hash = merkleNode(proof[0], hash)
+			}
+			proof = proof[1:]
+		}
+		idx /= 2
+		levelLen = (levelLen + 1) / 2
+	}
+
+	return len(proof) == 0 && bytes.Equal(hash, root)
+}
+
+func merkleTlvData(body []byte, chunkSize int) ([]byte, error) {
+	root, err := MerkleRoot(body, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 4, MERKLE_TLV_LEN)
+	binary.LittleEndian.PutUint32(data, uint32(chunkSize))
+	return append(data, root...), nil
+}
+
+/*
+ * Returns the chunk size and root from the image's Merkle TLV.
+ */
+func (pi *ParsedImage) MerkleRoot() (int, []byte, error) {
+	tlv := pi.FindTlv(IMAGE_TLV_MERKLE)
+	if tlv == nil {
+		return 0, nil, util.NewNewtError("Image has no Merkle TLV")
+	}
+	if len(tlv.Data) != MERKLE_TLV_LEN {
+		return 0, nil, util.NewNewtError(fmt.Sprintf("Bad Merkle TLV "+
+			"length %d", len(tlv.Data)))
+	}
+
+	chunkSize := int(binary.LittleEndian.Uint32(tlv.Data))
+	return chunkSize, tlv.Data[4:], nil
+}
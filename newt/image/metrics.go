@@ -0,0 +1,55 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"fmt"
+)
+
+/*
+ * Formats the image's size metrics in the Prometheus text exposition
+ * format, each labelled with the image version.
+ */
+func (pi *ParsedImage) MetricsText() string {
+	tlvSz, _ := pi.TlvOverhead()
+	metrics := []struct {
+		name  string
+		help  string
+		value int
+	}{
+		{"newt_image_size_bytes", "Total size of the image.",
+			pi.TotalSize()},
+		{"newt_image_body_size_bytes", "Size of the image body.",
+			len(pi.Body)},
+		{"newt_image_tlv_overhead_bytes", "Size of the image TLV trailer.",
+			tlvSz},
+	}
+
+	buf := &bytes.Buffer{}
+	for _, m := range metrics {
+		fmt.Fprintf(buf, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(buf, "# TYPE %s gauge\n", m.name)
+		fmt.Fprintf(buf, "%s{version=\"%s\"} %d\n", m.name,
+			pi.Hdr.Vers.String(), m.value)
+	}
+
+	return buf.String()
+}
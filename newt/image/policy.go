@@ -0,0 +1,99 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"fmt"
+
+	"mynewt.apache.org/newt/util"
+)
+
+/*
+ * Release-gate rules on which TLVs an image carries.
+ */
+type ImagePolicy struct {
+	RequiredTlvs  []uint8 /* Each of these must be present */
+	ForbiddenTlvs []uint8 /* None of these may be present */
+
+	/*
+	 * Approved signature TLV types.  If non-empty, the image must carry at
+	 * least one signature, and all of its signatures must be of these
+	 * types.
+	 */
+	SigTlvs []uint8
+}
+
+func containsTlvType(types []uint8, tlvType uint8) bool {
+	for _, t := range types {
+		if t == tlvType {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (pi *ParsedImage) CheckPolicy(policy ImagePolicy) error {
+	for _, tlvType := range policy.RequiredTlvs {
+		if pi.FindTlv(tlvType) == nil {
+			return util.NewNewtError(fmt.Sprintf("Image lacks required %s "+
+				"TLV", TlvTypeName(tlvType)))
+		}
+	}
+
+	signed := false
+	for _, tlv := range pi.Tlvs {
+		if containsTlvType(policy.ForbiddenTlvs, tlv.Hdr.Type) {
+			return util.NewNewtError(fmt.Sprintf("Image contains "+
+				"forbidden %s TLV", TlvTypeName(tlv.Hdr.Type)))
+		}
+		if len(policy.SigTlvs) > 0 && isSigTlv(tlv.Hdr.Type) {
+			if !containsTlvType(policy.SigTlvs, tlv.Hdr.Type) {
+				return util.NewNewtError(fmt.Sprintf("Image signed with "+
+					"unapproved algorithm %s", TlvTypeName(tlv.Hdr.Type)))
+			}
+			signed = true
+		}
+	}
+	if len(policy.SigTlvs) > 0 && !signed {
+		return util.NewNewtError("Image is not signed")
+	}
+
+	return nil
+}
+
+/*
+ * Enforces a maximum number of TLVs per type.  Types absent from limits are
+ * unrestricted.
+ */
+func (pi *ParsedImage) CheckTlvCounts(limits map[uint8]int) error {
+	counts := map[uint8]int{}
+	for _, tlv := range pi.Tlvs {
+		counts[tlv.Hdr.Type]++
+
+		limit, ok := limits[tlv.Hdr.Type]
+		if ok && counts[tlv.Hdr.Type] > limit {
+			return util.NewNewtError(fmt.Sprintf("Image has too many %s "+
+				"TLVs (max %d)", TlvTypeName(tlv.Hdr.Type), limit))
+		}
+	}
+
+	return nil
+}
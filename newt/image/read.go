@@ -0,0 +1,1069 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+
+	"mynewt.apache.org/newt/util"
+)
+
+/*
+ * Image read back from a .img file.
+ */
+type ParsedImage struct {
+	Hdr     ImageHdr
+	ImgSz64 uint64 /* Body size if Hdr.Magic is IMAGE_MAGIC_64 */
+	HdrPad  []byte /* Bytes between IMAGE_HEADER_SIZE and HdrSz */
+	Body    []byte
+	Tlvs    []ParsedTlv
+
+	HashScope int /* What the hash covers; HASH_SCOPE_HDR_BODY by default */
+	TlvAlign  int /* TLV alignment kept when the trailer is rewritten */
+}
+
+type ParsedTlv struct {
+	Hdr  ImageTrailerTlv
+	Data []byte
+}
+
+const maxInt = int(^uint(0) >> 1)
+
+/*
+ * Controls how ParseImage() builds a ParsedImage from a buffer.
+ */
+type ParseOptions struct {
+	/*
+	 * Point the body and TLV data into the caller's buffer rather than
+	 * copying them.  Saves an allocation per region and TLV when verifying
+	 * many images; the buffer must not be modified while the parsed image
+	 * is in use.
+	 */
+	NoCopy bool
+}
+
+/*
+ * Splits a trailer into its TLVs.  Each TLV's data refers to the trailer
+ * buffer rather than a copy.
+ */
+func parseTlvs(data []byte) ([]ParsedTlv, error) {
+	tlvs := []ParsedTlv{}
+
+	off := 0
+	for off < len(data) {
+		if len(data)-off < 4 {
+			return nil, util.NewNewtError(fmt.Sprintf("Truncated TLV "+
+				"header at trailer offset %d", off))
+		}
+		tlv := ParsedTlv{
+			Hdr: ImageTrailerTlv{
+				Type: data[off],
+				Pad:  data[off+1],
+				Len:  binary.LittleEndian.Uint16(data[off+2:]),
+			},
+		}
+		off += 4
+
+		dataLen := int(tlv.Hdr.Len)
+		if dataLen+int(tlv.Hdr.Pad) > len(data)-off {
+			return nil, util.NewNewtError(fmt.Sprintf("TLV type %d "+
+				"overruns trailer; len=%d pad=%d remaining=%d",
+				tlv.Hdr.Type, tlv.Hdr.Len, tlv.Hdr.Pad, len(data)-off))
+		}
+		tlv.Data = data[off : off+dataLen : off+dataLen]
+
+		/* Skip alignment padding. */
+		off += dataLen + int(tlv.Hdr.Pad)
+
+		tlvs = append(tlvs, tlv)
+	}
+
+	return tlvs, nil
+}
+
+/*
+ * Decodes a standard or 64-bit size image header.  The fields common to
+ * both go in pi.Hdr; the size from a 64-bit header goes in pi.ImgSz64.
+ */
+func (pi *ParsedImage) readHdr(r io.Reader) error {
+	raw := make([]byte, IMAGE_HEADER_SIZE)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return util.NewNewtError(fmt.Sprintf("Failed to read image "+
+			"header: %s", err.Error()))
+	}
+
+	if binary.LittleEndian.Uint32(raw) != IMAGE_MAGIC_64 {
+		binary.Read(bytes.NewReader(raw), binary.LittleEndian, &pi.Hdr)
+		return nil
+	}
+
+	hdr64 := ImageHdr64{}
+	binary.Read(bytes.NewReader(raw), binary.LittleEndian, &hdr64)
+	pi.Hdr = ImageHdr{
+		Magic: hdr64.Magic,
+		TlvSz: hdr64.TlvSz,
+		KeyId: hdr64.KeyId,
+		Pad1:  hdr64.Pad1,
+		HdrSz: hdr64.HdrSz,
+		Pad2:  hdr64.Pad2,
+		Flags: hdr64.Flags,
+		Vers:  hdr64.Vers,
+	}
+	pi.ImgSz64 = hdr64.ImgSz
+
+	return nil
+}
+
+/*
+ * Whether the image uses the ImageHdr64 header.
+ */
+func (pi *ParsedImage) WideHdr() bool {
+	return pi.Hdr.Magic == IMAGE_MAGIC_64
+}
+
+/*
+ * Body size recorded in the header, whichever header form is used.
+ */
+func (pi *ParsedImage) BodySize() uint64 {
+	if pi.WideHdr() {
+		return pi.ImgSz64
+	}
+	return uint64(pi.Hdr.ImgSz)
+}
+
+/*
+ * Serializes the header in the form it was read in.
+ */
+func (pi *ParsedImage) writeHdr(w io.Writer) error {
+	if pi.WideHdr() {
+		return binary.Write(w, binary.LittleEndian,
+			wideImageHdr(&pi.Hdr, pi.ImgSz64))
+	}
+	return binary.Write(w, binary.LittleEndian, &pi.Hdr)
+}
+
+/*
+ * Checks the header fields the parsers rely on to find the image regions.
+ */
+func (pi *ParsedImage) checkHdr() error {
+	if pi.Hdr.Magic != IMAGE_MAGIC && pi.Hdr.Magic != IMAGE_MAGIC_64 {
+		return util.NewNewtError(fmt.Sprintf("Bad image magic 0x%08x",
+			pi.Hdr.Magic))
+	}
+	if pi.Hdr.HdrSz < IMAGE_HEADER_SIZE {
+		return util.NewNewtError(fmt.Sprintf("Invalid image header "+
+			"size %d", pi.Hdr.HdrSz))
+	}
+
+	/*
+	 * A 64-bit header can claim more than the host can address; reject
+	 * that before anything is read.
+	 */
+	if pi.BodySize() > uint64(maxInt-2*math.MaxUint16) {
+		return util.NewNewtError(fmt.Sprintf("Image body size %d too "+
+			"large", pi.BodySize()))
+	}
+
+	return nil
+}
+
+/*
+ * Reads an image from r.  A gzip stream is decompressed transparently.
+ * Nothing past the end of an uncompressed image is consumed, so images
+ * stored back-to-back can be read with successive calls.
+ */
+func ReadImage(r io.Reader) (*ParsedImage, error) {
+	/*
+	 * Sniff the gzip magic without reading ahead, then put the bytes back
+	 * in front of the rest of the input.
+	 */
+	magic := make([]byte, 2)
+	n, _ := io.ReadFull(r, magic)
+	r = io.MultiReader(bytes.NewReader(magic[:n]), r)
+	if isGzip(magic[:n]) {
+		gr, err := newGzipReader(r)
+		if err != nil {
+			return nil, err
+		}
+		r = gr
+	}
+
+	pi := &ParsedImage{}
+
+	if err := pi.readHdr(r); err != nil {
+		return nil, err
+	}
+	if err := pi.checkHdr(); err != nil {
+		return nil, err
+	}
+
+	/*
+	 * Read each region in turn, keeping count so a truncated image can be
+	 * reported as such.  Regions are copied into growing buffers rather
+	 * than allocated from the header sizes up front, so a corrupt header
+	 * yields a truncation error instead of a huge allocation.
+	 */
+	have := IMAGE_HEADER_SIZE
+	readRegion := func(name string, size uint64) ([]byte, error) {
+		buf := &bytes.Buffer{}
+		n, err := io.CopyN(buf, r, int64(size))
+		have += int(n)
+		if err == io.EOF {
+			return nil, util.NewNewtError(fmt.Sprintf("Image truncated in "+
+				"%s; expected %d bytes, have %d", name, pi.TotalSize(),
+				have))
+		} else if err != nil {
+			return nil, util.NewNewtError(fmt.Sprintf("Failed to read "+
+				"image %s: %s", name, err.Error()))
+		}
+		return buf.Bytes(), nil
+	}
+
+	var err error
+	pi.HdrPad, err = readRegion("header padding",
+		uint64(pi.Hdr.HdrSz-IMAGE_HEADER_SIZE))
+	if err != nil {
+		return nil, err
+	}
+
+	pi.Body, err = readRegion("body", pi.BodySize())
+	if err != nil {
+		return nil, err
+	}
+
+	trailer, err := readRegion("trailer", uint64(pi.Hdr.TlvSz))
+	if err != nil {
+		return nil, err
+	}
+	/* The trailer buffer is ours, so the TLVs can refer to it. */
+	tlvs, err := parseTlvs(trailer)
+	if err != nil {
+		return nil, err
+	}
+	pi.Tlvs = tlvs
+	pi.TlvAlign = pi.inferTlvAlign()
+
+	return pi, nil
+}
+
+/*
+ * Parses an image held in memory.  Any data following the image is
+ * ignored.
+ */
+func ParseImage(data []byte, opts ParseOptions) (*ParsedImage, error) {
+	if !opts.NoCopy {
+		return ReadImage(bytes.NewReader(data))
+	}
+
+	pi := &ParsedImage{}
+	if err := pi.readHdr(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	if err := pi.checkHdr(); err != nil {
+		return nil, err
+	}
+	if pi.TotalSize() > len(data) {
+		return nil, util.NewNewtError(fmt.Sprintf("Image truncated; "+
+			"expected %d bytes, have %d", pi.TotalSize(), len(data)))
+	}
+
+	hdrEnd := int(pi.Hdr.HdrSz)
+	bodyEnd := hdrEnd + int(pi.BodySize())
+	pi.HdrPad = data[IMAGE_HEADER_SIZE:hdrEnd:hdrEnd]
+	pi.Body = data[hdrEnd:bodyEnd:bodyEnd]
+
+	tlvs, err := parseTlvs(data[bodyEnd:pi.TotalSize()])
+	if err != nil {
+		return nil, err
+	}
+	pi.Tlvs = tlvs
+	pi.TlvAlign = pi.inferTlvAlign()
+
+	return pi, nil
+}
+
+func isGzip(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+func newGzipReader(r io.Reader) (io.Reader, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, util.NewNewtError(fmt.Sprintf("Failed to decompress "+
+			"image: %s", err.Error()))
+	}
+
+	return gr, nil
+}
+
+/*
+ * Returns a reader yielding the decompressed contents of r if r contains
+ * gzip data, or the contents of r unchanged otherwise.  Tools that read
+ * image data themselves can use this to accept gzipped images; the
+ * package's readers already do.
+ */
+func NewImageReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(2)
+	if err != nil || !isGzip(magic) {
+		/* Not gzip; let the image parser report any read errors. */
+		return br, nil
+	}
+
+	return newGzipReader(br)
+}
+
+/*
+ * Reads an image from a file.  Gzip-compressed files are decompressed
+ * transparently.  The file must contain exactly one image; trailing data
+ * after the size given by the header is an error.
+ */
+func ReadImageFile(filename string) (*ParsedImage, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, util.NewNewtError(fmt.Sprintf("Can't open image %s: %s",
+			filename, err.Error()))
+	}
+	defer f.Close()
+
+	r, err := NewImageReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	pi, err := ReadImage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	extra, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return nil, util.NewNewtError(fmt.Sprintf("Can't read image %s: %s",
+			filename, err.Error()))
+	}
+	if extra != 0 {
+		return nil, util.NewNewtError(fmt.Sprintf("Image file %s has %d "+
+			"bytes of trailing data after the %d-byte image", filename,
+			extra, pi.TotalSize()))
+	}
+
+	return pi, nil
+}
+
+/*
+ * Reads a sequence of images stored back-to-back (e.g., bootloader, loader
+ * and app in one factory image) until the end of the input.  A gzip stream
+ * is decompressed transparently.
+ */
+func ReadImages(r io.Reader) ([]*ParsedImage, error) {
+	r, err := NewImageReader(r)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(r)
+
+	images := []*ParsedImage{}
+	off := 0
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, util.NewNewtError(fmt.Sprintf("Failed to read "+
+				"images: %s", err.Error()))
+		}
+
+		pi, err := ReadImage(br)
+		if err != nil {
+			return nil, util.NewNewtError(fmt.Sprintf("Image %d at offset "+
+				"%d: %s", len(images), off, err.(*util.NewtError).Text))
+		}
+		images = append(images, pi)
+		off += pi.TotalSize()
+	}
+
+	return images, nil
+}
+
+/*
+ * Returns the first TLV of the given type, or nil if there isn't one.
+ */
+func (pi *ParsedImage) FindTlv(tlvType uint8) *ParsedTlv {
+	for i, _ := range pi.Tlvs {
+		if pi.Tlvs[i].Hdr.Type == tlvType {
+			return &pi.Tlvs[i]
+		}
+	}
+
+	return nil
+}
+
+/*
+ * Returns the digest indicated by the header flags.  Images that indicate
+ * none are taken to use SHA256.
+ */
+func (pi *ParsedImage) HashAlg() *HashAlg {
+	for _, alg := range sortedHashAlgs() {
+		if pi.Hdr.Flags&alg.Flag != 0 {
+			return alg
+		}
+	}
+	return hashAlgs[HASH_ALG_SHA256]
+}
+
+/*
+ * Returns the TLV holding the image hash, as indicated by the header flags.
+ */
+func (pi *ParsedImage) HashTlv() (*ParsedTlv, error) {
+	alg := pi.HashAlg()
+	tlv := pi.FindTlv(alg.TlvType)
+	if tlv == nil {
+		return nil, util.NewNewtError(fmt.Sprintf("Image has no %s TLV",
+			TlvTypeName(alg.TlvType)))
+	}
+	return tlv, nil
+}
+
+type hashRegion struct {
+	name string
+	data []byte
+}
+
+/*
+ * The regions of the image covered by the hash, in the order they are
+ * hashed.
+ */
+func (pi *ParsedImage) hashRegions() []hashRegion {
+	regions := []hashRegion{}
+	if pi.HashScope == HASH_SCOPE_HDR_BODY {
+		hdr := &bytes.Buffer{}
+		pi.writeHdr(hdr)
+		regions = append(regions,
+			hashRegion{"header", hdr.Bytes()},
+			hashRegion{"header padding", pi.HdrPad})
+	}
+
+	return append(regions, hashRegion{"body", pi.Body})
+}
+
+/*
+ * Computes the image hash the same way Generate() does: over the header
+ * (including any padding up to HdrSz) followed by the body, or over the body
+ * alone if HashScope is HASH_SCOPE_BODY.
+ */
+func (pi *ParsedImage) CalcHash() []byte {
+	hash := pi.HashAlg().New()
+	for _, region := range pi.hashRegions() {
+		hash.Write(region.data)
+	}
+
+	return hash.Sum(nil)
+}
+
+/*
+ * Explains why two images that were expected to be identical hash
+ * differently, by naming the first hashed region that differs and the
+ * offset within it, e.g., "body differs at offset 0x240".
+ */
+func HashMismatchReason(a *ParsedImage, b *ParsedImage) string {
+	if a.HashScope != b.HashScope {
+		return fmt.Sprintf("hash scopes differ (%d vs %d)", a.HashScope,
+			b.HashScope)
+	}
+
+	ra := a.hashRegions()
+	rb := b.hashRegions()
+	for i, _ := range ra {
+		da := ra[i].data
+		db := rb[i].data
+
+		off := 0
+		for off < len(da) && off < len(db) && da[off] == db[off] {
+			off++
+		}
+		if off < len(da) || off < len(db) {
+			if off == len(da) || off == len(db) {
+				return fmt.Sprintf("%s sizes differ (%d vs %d bytes)",
+					ra[i].name, len(da), len(db))
+			}
+			return fmt.Sprintf("%s differs at offset 0x%x", ra[i].name,
+				off)
+		}
+	}
+
+	return "hashed contents are identical"
+}
+
+/*
+ * Size of the serialized image: header, body and trailer.
+ */
+func (pi *ParsedImage) TotalSize() int {
+	return int(pi.Hdr.HdrSz) + int(pi.BodySize()) + int(pi.Hdr.TlvSz)
+}
+
+/*
+ * Reports the size of the TLV trailer, in bytes and as a percentage of the
+ * total image size.
+ */
+func (pi *ParsedImage) TlvOverhead() (int, float64) {
+	tlvSz := int(pi.Hdr.TlvSz)
+	return tlvSz, float64(tlvSz) * 100.0 / float64(pi.TotalSize())
+}
+
+/*
+ * Reports how much of a flash slot the image occupies.
+ */
+func (pi *ParsedImage) SlotUtilization(slotSize int) (int, int, float64) {
+	used := pi.TotalSize()
+	if slotSize <= 0 {
+		return used, slotSize, 0
+	}
+
+	return used, slotSize, float64(used) * 100.0 / float64(slotSize)
+}
+
+/*
+ * Serializes the image in .img format.
+ */
+func (pi *ParsedImage) Write(w io.Writer) error {
+	err := pi.writeHdr(w)
+	if err != nil {
+		return util.NewNewtError(fmt.Sprintf("Failed to serialize image "+
+			"hdr: %s", err.Error()))
+	}
+	if _, err := w.Write(pi.HdrPad); err != nil {
+		return util.NewNewtError(fmt.Sprintf("Failed to write image: %s",
+			err.Error()))
+	}
+	if _, err := w.Write(pi.Body); err != nil {
+		return util.NewNewtError(fmt.Sprintf("Failed to write image: %s",
+			err.Error()))
+	}
+	for _, tlv := range pi.Tlvs {
+		err := binary.Write(w, binary.LittleEndian, &tlv.Hdr)
+		if err != nil {
+			return util.NewNewtError(fmt.Sprintf("Failed to serialize "+
+				"image trailer: %s", err.Error()))
+		}
+		if _, err := w.Write(tlv.Data); err != nil {
+			return util.NewNewtError(fmt.Sprintf("Failed to write image: "+
+				"%s", err.Error()))
+		}
+		if _, err := w.Write(make([]byte, tlv.Hdr.Pad)); err != nil {
+			return util.NewNewtError(fmt.Sprintf("Failed to write image: "+
+				"%s", err.Error()))
+		}
+	}
+
+	return nil
+}
+
+func (pi *ParsedImage) Bytes() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := pi.Write(buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+/*
+ * Name of the signature algorithm indicated by the header flags, or "none"
+ * for unsigned images.  Images signed with several algorithms produce a
+ * '+' separated list.
+ */
+func (pi *ParsedImage) SigAlg() string {
+	algs := []string{}
+	if pi.Hdr.Flags&IMAGE_F_PKCS15_RSA2048_SHA256 != 0 {
+		algs = append(algs, TlvTypeName(IMAGE_TLV_RSA2048))
+	}
+	if pi.Hdr.Flags&IMAGE_F_ECDSA224_SHA256 != 0 {
+		algs = append(algs, TlvTypeName(IMAGE_TLV_ECDSA224))
+	}
+	if len(algs) == 0 {
+		return "none"
+	}
+
+	return strings.Join(algs, "+")
+}
+
+/*
+ * Lists the bootloader capabilities needed to boot this image, based on its
+ * header flags and TLVs.  Deployment tools can compare this against what a
+ * device's loader supports before pushing the image.
+ */
+func (pi *ParsedImage) RequiredLoaderFeatures() []string {
+	features := []string{}
+
+	if pi.WideHdr() {
+		features = append(features, "64-bit-image-size")
+	}
+	if pi.Hdr.Flags&IMAGE_F_PIC != 0 {
+		features = append(features, "position-independent")
+	}
+	for _, alg := range sortedHashAlgs() {
+		if pi.Hdr.Flags&alg.Flag != 0 {
+			features = append(features, alg.Name)
+			if pi.HashScope == HASH_SCOPE_BODY {
+				features = append(features, "body-only-hash")
+			}
+		}
+	}
+	if pi.Hdr.Flags&IMAGE_F_PKCS15_RSA2048_SHA256 != 0 {
+		features = append(features, "rsa2048-pkcs15-verification")
+	}
+	if pi.Hdr.Flags&IMAGE_F_ECDSA224_SHA256 != 0 {
+		features = append(features, "ecdsa-p224-verification")
+	}
+
+	/*
+	 * Identity "compression" needs nothing from the loader.  A scheme that
+	 * can't be determined is still reported, since the loader would have
+	 * to understand it.
+	 */
+	c, err := pi.Compression()
+	if _, known := compressNames[c]; err != nil || !known {
+		features = append(features, "unknown-compression")
+	} else if c != IMAGE_COMPRESS_NONE && c != IMAGE_COMPRESS_IDENTITY {
+		features = append(features, CompressionName(c)+"-decompression")
+	}
+
+	if pi.FindTlv(IMAGE_TLV_MIN_PREV) != nil {
+		features = append(features, "min-prev-version-check")
+	}
+	if pi.FindTlv(IMAGE_TLV_DEV_MODS) != nil {
+		features = append(features, "device-model-check")
+	}
+
+	/* Loaders that predate TLV alignment can't skip the padding. */
+	for _, tlv := range pi.Tlvs {
+		if tlv.Hdr.Pad != 0 {
+			features = append(features, "tlv-padding")
+			break
+		}
+	}
+
+	return features
+}
+
+func isSigTlv(tlvType uint8) bool {
+	return tlvType == IMAGE_TLV_RSA2048 || tlvType == IMAGE_TLV_ECDSA224
+}
+
+/*
+ * Serializes the image with the contents of all signature TLVs zeroed.
+ * Signatures are non-deterministic, so two reproducible builds yield the
+ * same canonical bytes even if they were signed separately.
+ */
+func (pi *ParsedImage) Canonicalize() []byte {
+	canon := *pi
+	canon.Tlvs = make([]ParsedTlv, len(pi.Tlvs))
+	for i, tlv := range pi.Tlvs {
+		canon.Tlvs[i] = tlv
+		if isSigTlv(tlv.Hdr.Type) {
+			canon.Tlvs[i].Data = make([]byte, len(tlv.Data))
+		}
+	}
+
+	/* Serializing to memory cannot fail. */
+	buf, _ := canon.Bytes()
+	return buf
+}
+
+/*
+ * Returns the body compression scheme.  Images without a compression TLV
+ * have an uncompressed body.
+ */
+func (pi *ParsedImage) Compression() (uint8, error) {
+	tlv := pi.FindTlv(IMAGE_TLV_COMPRESS)
+	if tlv == nil {
+		return IMAGE_COMPRESS_NONE, nil
+	}
+	if len(tlv.Data) != 1 {
+		return 0, util.NewNewtError(fmt.Sprintf("Bad compression TLV "+
+			"length %d", len(tlv.Data)))
+	}
+
+	return tlv.Data[0], nil
+}
+
+func newParsedTlv(tlvType uint8, data []byte) ParsedTlv {
+	return ParsedTlv{
+		Hdr: ImageTrailerTlv{
+			Type: tlvType,
+			Pad:  0,
+			Len:  uint16(len(data)),
+		},
+		Data: data,
+	}
+}
+
+/*
+ * Image offset of the start of the trailer.
+ */
+func (pi *ParsedImage) trailerOffset() int {
+	return int(pi.Hdr.HdrSz) + int(pi.BodySize())
+}
+
+/*
+ * Number of bytes needed to advance offset off to a multiple of align.
+ */
+func alignPad(off int, align int) int {
+	if align <= 1 {
+		return 0
+	}
+	return (align - off%align) % align
+}
+
+/*
+ * Number of padding bytes needed after a TLV with the given data length,
+ * starting at image offset off, so that the next TLV is align-byte aligned.
+ */
+func tlvPadAt(off int, dataLen int, align int) int {
+	return alignPad(off+4+dataLen, align)
+}
+
+/*
+ * Sets the Pad field of each TLV for pi.TlvAlign, assuming the TLVs follow
+ * the body in order.  Returns the resulting trailer size.
+ */
+func (pi *ParsedImage) padTlvs(tlvs []ParsedTlv) int {
+	off := pi.trailerOffset()
+	for i, _ := range tlvs {
+		tlvs[i].Hdr.Pad = uint8(tlvPadAt(off, len(tlvs[i].Data),
+			pi.TlvAlign))
+		off += 4 + len(tlvs[i].Data) + int(tlvs[i].Hdr.Pad)
+	}
+
+	return off - pi.trailerOffset()
+}
+
+/*
+ * Guesses the TLV alignment the image was generated with.  Images without
+ * any TLV padding report 0.  Otherwise, this is the largest power of two
+ * up to 256 that every TLV's image offset is a multiple of; this may be
+ * larger than the alignment originally requested, but satisfies it.
+ */
+func (pi *ParsedImage) inferTlvAlign() int {
+	padded := false
+	for _, tlv := range pi.Tlvs {
+		if tlv.Hdr.Pad != 0 {
+			padded = true
+		}
+	}
+	if !padded {
+		return 0
+	}
+
+	for align := 256; align > 1; align /= 2 {
+		if pi.CheckTlvAlignment(align) == nil {
+			return align
+		}
+	}
+	return 0
+}
+
+/*
+ * Checks that every TLV header starts at a multiple of align bytes from the
+ * start of the image.  With the image placed at an aligned flash address,
+ * this is the TLV's alignment in flash.
+ */
+func (pi *ParsedImage) CheckTlvAlignment(align int) error {
+	if align <= 0 {
+		return util.NewNewtError(fmt.Sprintf("Invalid TLV alignment %d",
+			align))
+	}
+
+	off := pi.trailerOffset()
+	for _, tlv := range pi.Tlvs {
+		if off%align != 0 {
+			return util.NewNewtError(fmt.Sprintf("%s TLV at image offset "+
+				"%d is not %d-byte aligned", TlvTypeName(tlv.Hdr.Type), off,
+				align))
+		}
+		off += 4 + len(tlv.Data) + int(tlv.Hdr.Pad)
+	}
+
+	return nil
+}
+
+/*
+ * Checks that the image header size is a multiple of the flash minimum write
+ * size; otherwise the body cannot be written on its own write boundary.
+ */
+func (pi *ParsedImage) CheckWriteUnit(writeUnit int) error {
+	if writeUnit <= 0 {
+		return util.NewNewtError(fmt.Sprintf("Invalid flash write unit %d",
+			writeUnit))
+	}
+	hdrSz := int(pi.Hdr.HdrSz)
+	if hdrSz%writeUnit != 0 {
+		next := (hdrSz/writeUnit + 1) * writeUnit
+		return util.NewNewtError(fmt.Sprintf("Image header size %d is not "+
+			"a multiple of flash write unit %d; next valid size is %d",
+			hdrSz, writeUnit, next))
+	}
+
+	return nil
+}
+
+/*
+ * Checks that the header padding between IMAGE_HEADER_SIZE and HdrSz
+ * consists only of padByte.  The padding is hashed, so unexpected contents
+ * make the image fail verification on the device.  Returns the image offset
+ * of the first unexpected byte, or -1 if the padding is as expected.
+ */
+func (pi *ParsedImage) CheckHdrPad(padByte byte) (int, error) {
+	bad := 0
+	first := -1
+	for i, b := range pi.HdrPad {
+		if b != padByte {
+			if first < 0 {
+				first = IMAGE_HEADER_SIZE + i
+			}
+			bad++
+		}
+	}
+	if first < 0 {
+		return -1, nil
+	}
+
+	return first, util.NewNewtError(fmt.Sprintf("Header padding contains "+
+		"%d unexpected byte(s); first at offset 0x%x is 0x%02x, want 0x%02x",
+		bad, first, pi.HdrPad[first-IMAGE_HEADER_SIZE], padByte))
+}
+
+const (
+	ECDSA224_SCALAR_LEN = 28
+)
+
+/*
+ * Returns the image's signature algorithm and signature.  RSA signatures are
+ * returned as is.  ECDSA signatures are returned DER encoded without the
+ * TLV's zero padding, or, if rawEcdsa is set, as fixed-width big-endian
+ * r || s.
+ */
+func (pi *ParsedImage) GetSignature(rawEcdsa bool) (string, []byte, error) {
+	for _, tlv := range pi.Tlvs {
+		switch tlv.Hdr.Type {
+		case IMAGE_TLV_RSA2048:
+			return TlvTypeName(tlv.Hdr.Type), tlv.Data, nil
+
+		case IMAGE_TLV_ECDSA224:
+			var sig ECDSASig
+			rest, err := asn1.Unmarshal(tlv.Data, &sig)
+			if err != nil {
+				return "", nil, util.NewNewtError(fmt.Sprintf("Bad ECDSA "+
+					"signature: %s", err))
+			}
+			if !rawEcdsa {
+				der := tlv.Data[:len(tlv.Data)-len(rest)]
+				return TlvTypeName(tlv.Hdr.Type), der, nil
+			}
+
+			r := sig.R.Bytes()
+			s := sig.S.Bytes()
+			if len(r) > ECDSA224_SCALAR_LEN || len(s) > ECDSA224_SCALAR_LEN {
+				return "", nil, util.NewNewtError("ECDSA signature too " +
+					"large for ECDSA224")
+			}
+			raw := make([]byte, 2*ECDSA224_SCALAR_LEN)
+			copy(raw[ECDSA224_SCALAR_LEN-len(r):], r)
+			copy(raw[2*ECDSA224_SCALAR_LEN-len(s):], s)
+			return TlvTypeName(tlv.Hdr.Type), raw, nil
+		}
+	}
+
+	return "", nil, util.NewNewtError("Image is not signed")
+}
+
+/*
+ * Computes the SHA256 a device would calculate over an entire flash slot
+ * containing this image, with the rest of the slot filled with padByte
+ * (typically 0xff, the erased flash value).
+ */
+func (pi *ParsedImage) ComputeSlotHash(slotSize int,
+	padByte byte) ([]byte, error) {
+
+	data, err := pi.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > slotSize {
+		return nil, util.NewNewtError(fmt.Sprintf("Image too large for "+
+			"slot; image=%d slot=%d", len(data), slotSize))
+	}
+
+	hash := sha256.New()
+	hash.Write(data)
+	hash.Write(bytes.Repeat([]byte{padByte}, slotSize-len(data)))
+
+	return hash.Sum(nil), nil
+}
+
+/*
+ * Describes the TLVs in the image trailer, for reporting.  The description
+ * of the hash TLV states what the hash covers.
+ */
+func (pi *ParsedImage) DescribeTlvs() []TlvDescription {
+	descs := []TlvDescription{}
+	for _, tlv := range pi.Tlvs {
+		info := tlvTypeInfos[tlv.Hdr.Type]
+		desc := info.desc
+		if isHashTlv(tlv.Hdr.Type) {
+			scope := "header+body"
+			if pi.HashScope == HASH_SCOPE_BODY {
+				scope = "body"
+			}
+			desc = fmt.Sprintf("%s of %s", info.name, scope)
+		}
+
+		descs = append(descs, TlvDescription{
+			Type:        tlv.Hdr.Type,
+			Name:        TlvTypeName(tlv.Hdr.Type),
+			Len:         int(tlv.Hdr.Len),
+			Description: desc,
+			Security:    info.security,
+		})
+	}
+
+	return descs
+}
+
+/*
+ * Returns the source revision from the image's VCS hash TLV, or "" if there
+ * is none.
+ */
+func (pi *ParsedImage) VcsHash() string {
+	tlv := pi.FindTlv(IMAGE_TLV_VCS_HASH)
+	if tlv == nil {
+		return ""
+	}
+	return string(tlv.Data)
+}
+
+/*
+ * Returns the BSP name from the image's BSP TLV, or "" if there is none.
+ */
+func (pi *ParsedImage) BspName() string {
+	tlv := pi.FindTlv(IMAGE_TLV_BSP_NAME)
+	if tlv == nil {
+		return ""
+	}
+	return string(tlv.Data)
+}
+
+/*
+ * Returns the device model IDs from the image's allowlist TLV, or nil if
+ * the image may be installed on any model.
+ */
+func (pi *ParsedImage) DeviceModels() ([]uint32, error) {
+	tlv := pi.FindTlv(IMAGE_TLV_DEV_MODS)
+	if tlv == nil {
+		return nil, nil
+	}
+	if len(tlv.Data) == 0 || len(tlv.Data)%4 != 0 {
+		return nil, util.NewNewtError(fmt.Sprintf("Bad DEV_MODS TLV "+
+			"length %d", len(tlv.Data)))
+	}
+
+	models := make([]uint32, len(tlv.Data)/4)
+	binary.Read(bytes.NewReader(tlv.Data), binary.LittleEndian, models)
+
+	return models, nil
+}
+
+/*
+ * Checks that the image may be installed on a device of the given model.
+ * Images without a model allowlist are accepted by every model.
+ */
+func (pi *ParsedImage) AcceptsDeviceModel(model uint32) error {
+	models, err := pi.DeviceModels()
+	if err != nil {
+		return err
+	}
+	if models == nil {
+		return nil
+	}
+
+	for _, m := range models {
+		if m == model {
+			return nil
+		}
+	}
+
+	return util.NewNewtError(fmt.Sprintf("Image not allowed on device "+
+		"model 0x%x", model))
+}
+
+/*
+ * Compact description of the image for log output, e.g.,
+ * "v1.2.3.4 size=12456 sig=ECDSA224 hash=ab12cd34... vcs=1f2e3d4c".
+ * Fields for optional TLVs are only included when the TLV is present.
+ */
+func (pi *ParsedImage) OneLineSummary() string {
+	hashStr := "none"
+	if tlv, err := pi.HashTlv(); err == nil {
+		hashStr = fmt.Sprintf("%x", tlv.Data)
+		if len(hashStr) > 8 {
+			hashStr = hashStr[:8] + "..."
+		}
+	}
+
+	summary := fmt.Sprintf("v%s size=%d sig=%s hash=%s",
+		pi.Hdr.Vers.String(), pi.TotalSize(), pi.SigAlg(), hashStr)
+	if vcsHash := pi.VcsHash(); vcsHash != "" {
+		summary += " vcs=" + vcsHash
+	}
+	if bspName := pi.BspName(); bspName != "" {
+		summary += " bsp=" + bspName
+	}
+	if pi.FindTlv(IMAGE_TLV_COMPRESS) != nil {
+		c, err := pi.Compression()
+		if err != nil {
+			summary += " compress=bad"
+		} else {
+			summary += " compress=" + CompressionName(c)
+		}
+	}
+	if minPrev, ok, err := pi.MinPrevVersion(); err == nil && ok {
+		summary += fmt.Sprintf(" min_prev=%s", minPrev.String())
+	}
+	if models, err := pi.DeviceModels(); err == nil && models != nil {
+		ids := make([]string, len(models))
+		for i, m := range models {
+			ids[i] = fmt.Sprintf("0x%x", m)
+		}
+		summary += " models=" + strings.Join(ids, ",")
+	}
+
+	return summary
+}
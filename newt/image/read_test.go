@@ -0,0 +1,426 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/binary"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestReadImageRoundTrip(t *testing.T) {
+	data, pi := generateTestImage(t, newTestImage(t, "1.2.3.4"),
+		testBody(1000))
+
+	if pi.TotalSize() != len(data) {
+		t.Fatalf("TotalSize %d, file size %d", pi.TotalSize(), len(data))
+	}
+	out, err := pi.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatal("re-serialized image differs from original")
+	}
+}
+
+func TestReadImageTruncated(t *testing.T) {
+	data, _ := generateTestImage(t, newTestImage(t, "1.0.0"), testBody(200))
+
+	for _, n := range []int{10, IMAGE_HEADER_SIZE + 50, len(data) - 1} {
+		if _, err := ReadImage(bytes.NewReader(data[:n])); err == nil {
+			t.Errorf("image truncated to %d bytes accepted", n)
+		}
+	}
+}
+
+/*
+ * An erased flash sector carrying a 64-bit header magic claims an
+ * enormous body; parsing must fail cleanly rather than allocate it.
+ */
+func TestReadImageHugeWideHdr(t *testing.T) {
+	data := bytes.Repeat([]byte{0xff}, 4096)
+	binary.LittleEndian.PutUint32(data, IMAGE_MAGIC_64)
+
+	if _, err := ReadImage(bytes.NewReader(data)); err == nil {
+		t.Fatal("bogus 64-bit header accepted")
+	}
+}
+
+func TestWideHdrRoundTrip(t *testing.T) {
+	image := newTestImage(t, "3.0.0")
+	image.SetWideHeader(true)
+	data, pi := generateTestImage(t, image, testBody(300))
+
+	if binary.LittleEndian.Uint32(data) != IMAGE_MAGIC_64 {
+		t.Fatal("wide header not written")
+	}
+	if !pi.WideHdr() || pi.BodySize() != 300 {
+		t.Fatalf("wide=%v size=%d", pi.WideHdr(), pi.BodySize())
+	}
+	if err := pi.VerifyHash(); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := pi.Bytes()
+	if !bytes.Equal(out, data) {
+		t.Fatal("re-serialized image differs from original")
+	}
+}
+
+func hasFeature(features []string, feature string) bool {
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRequiredLoaderFeatures(t *testing.T) {
+	_, pi := generateTestImage(t, newTestImage(t, "1.0.0"), testBody(10))
+	if hasFeature(pi.RequiredLoaderFeatures(), "device-model-check") {
+		t.Error("device-model-check required without DEV_MODS")
+	}
+	if hasFeature(pi.RequiredLoaderFeatures(), "min-prev-version-check") {
+		t.Error("min-prev-version-check required without MIN_PREV")
+	}
+
+	image := newTestImage(t, "1.0.0")
+	if err := image.SetDeviceModels([]uint32{7}); err != nil {
+		t.Fatal(err)
+	}
+	_, pi = generateTestImage(t, image, testBody(10))
+	if !hasFeature(pi.RequiredLoaderFeatures(), "device-model-check") {
+		t.Error("device-model-check not required with DEV_MODS")
+	}
+
+	image = newTestImage(t, "2.0.0")
+	if err := image.SetMinPrevVersion("1.5.0"); err != nil {
+		t.Fatal(err)
+	}
+	_, pi = generateTestImage(t, image, testBody(10))
+	if !hasFeature(pi.RequiredLoaderFeatures(), "min-prev-version-check") {
+		t.Error("min-prev-version-check not required with MIN_PREV")
+	}
+}
+
+func TestRequiredLoaderFeaturesCompression(t *testing.T) {
+	_, pi := generateTestImage(t, newTestImage(t, "1.0.0"), testBody(10))
+
+	for _, c := range []uint8{IMAGE_COMPRESS_NONE, IMAGE_COMPRESS_IDENTITY} {
+		pi.Tlvs = append(pi.Tlvs[:1], newParsedTlv(IMAGE_TLV_COMPRESS,
+			[]byte{c}))
+		features := pi.RequiredLoaderFeatures()
+		if hasFeature(features, "unknown-compression") ||
+			hasFeature(features, CompressionName(c)+"-decompression") {
+
+			t.Errorf("%s compression reported: %v", CompressionName(c),
+				features)
+		}
+	}
+
+	/* Malformed and unrecognized TLVs must not be silently ignored. */
+	for _, data := range [][]byte{{}, {IMAGE_COMPRESS_NONE, 0}, {0xee}} {
+		pi.Tlvs = append(pi.Tlvs[:1], newParsedTlv(IMAGE_TLV_COMPRESS,
+			data))
+		if !hasFeature(pi.RequiredLoaderFeatures(), "unknown-compression") {
+			t.Errorf("compression TLV %x not reported", data)
+		}
+	}
+}
+
+func TestCheckWriteUnit(t *testing.T) {
+	_, pi := generateTestImage(t, newTestImage(t, "1.0.0"), testBody(10))
+	if err := pi.CheckWriteUnit(8); err != nil {
+		t.Fatal(err)
+	}
+
+	/* A padded header is checked at its actual size. */
+	pi.Hdr.HdrSz = IMAGE_HEADER_SIZE + 16
+	if err := pi.CheckWriteUnit(16); err != nil {
+		t.Fatal(err)
+	}
+	if err := pi.CheckWriteUnit(64); err == nil {
+		t.Fatal("48-byte header accepted for 64-byte write unit")
+	}
+}
+
+func TestOneLineSummary(t *testing.T) {
+	image := newTestImage(t, "1.2.3.4")
+	image.SetVcsHash("1f2e3d4c")
+	image.SetBspName("hw/bsp/nrf52dk")
+	image.SetCompression(IMAGE_COMPRESS_IDENTITY)
+	image.SetMinPrevVersion("1.0.0")
+	_, pi := generateTestImage(t, image, testBody(10))
+
+	summary := pi.OneLineSummary()
+	for _, field := range []string{"v1.2.3.4", "vcs=1f2e3d4c",
+		"bsp=hw/bsp/nrf52dk", "compress=identity", "min_prev=1.0.0"} {
+
+		if !strings.Contains(summary, field) {
+			t.Errorf("summary %q lacks %q", summary, field)
+		}
+	}
+}
+
+func TestReadImageFileTrailingData(t *testing.T) {
+	data, _ := generateTestImage(t, newTestImage(t, "1.0.0"), testBody(100))
+
+	f, err := ioutil.TempFile("", "image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(data)
+	f.Close()
+
+	if _, err := ReadImageFile(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(f.Name(), append(data, 0xff), 0644)
+	if _, err := ReadImageFile(f.Name()); err == nil {
+		t.Fatal("image with trailing byte accepted")
+	}
+}
+
+func TestParseImageNoCopy(t *testing.T) {
+	data, _ := generateTestImage(t, newTestImage(t, "1.0.0"), testBody(100))
+
+	for _, opts := range []ParseOptions{{}, {NoCopy: true}} {
+		pi, err := ParseImage(data, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pi.VerifyStructure(); err != nil {
+			t.Fatal(err)
+		}
+		if err := pi.VerifyHash(); err != nil {
+			t.Fatal(err)
+		}
+		out, _ := pi.Bytes()
+		if !bytes.Equal(out, data) {
+			t.Fatalf("%+v: re-serialized image differs", opts)
+		}
+
+		/* Only a no-copy parse sees changes to the buffer. */
+		data[IMAGE_HEADER_SIZE] ^= 0xff
+		changed := pi.Body[0] != testBody(1)[0]
+		data[IMAGE_HEADER_SIZE] ^= 0xff
+		if changed != opts.NoCopy {
+			t.Errorf("%+v: body shares buffer: %v", opts, changed)
+		}
+	}
+
+	if _, err := ParseImage(data[:len(data)-1],
+		ParseOptions{NoCopy: true}); err == nil {
+
+		t.Fatal("truncated image accepted")
+	}
+}
+
+var (
+	benchImagesOnce sync.Once
+	benchImages     [][]byte
+)
+
+/*
+ * Parses and verifies a set of signed images, as a fleet update server
+ * would.  Run with -benchmem to compare allocations between parse modes.
+ */
+func benchmarkParseVerify(b *testing.B, opts ParseOptions) {
+	_, ecKey := testKeys(b)
+	benchImagesOnce.Do(func() {
+		for i := 0; i < 1000; i++ {
+			image := newTestImage(b, "1.0.0")
+			image.SetSigningPrivateKey(ecKey, 0)
+			data, _ := generateTestImage(b, image, testBody(4096+i))
+			benchImages = append(benchImages, data)
+		}
+	})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pi, err := ParseImage(benchImages[i%len(benchImages)], opts)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := pi.VerifyHash(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseVerifyCopy(b *testing.B) {
+	benchmarkParseVerify(b, ParseOptions{})
+}
+
+func BenchmarkParseVerifyNoCopy(b *testing.B) {
+	benchmarkParseVerify(b, ParseOptions{NoCopy: true})
+}
+
+func TestGetSignature(t *testing.T) {
+	rsaKey, ecKey := testKeys(t)
+
+	_, pi := generateTestImage(t, newTestImage(t, "1.0.0"), testBody(10))
+	if _, _, err := pi.GetSignature(false); err == nil {
+		t.Error("unsigned image returned a signature")
+	}
+
+	image := newTestImage(t, "1.0.0")
+	image.SetSigningPrivateKey(rsaKey, 0)
+	_, pi = generateTestImage(t, image, testBody(10))
+	hash := pi.CalcHash()
+
+	/* RSA signatures come back as is, whatever the ECDSA option. */
+	for _, raw := range []bool{false, true} {
+		alg, sig, err := pi.GetSignature(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if alg != "RSA2048" || len(sig) != RSA2048_SIG_LEN {
+			t.Fatalf("alg=%s len=%d", alg, len(sig))
+		}
+		err = rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, hash, sig)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	image = newTestImage(t, "1.0.0")
+	image.SetSigningPrivateKey(ecKey, 0)
+	_, pi = generateTestImage(t, image, testBody(10))
+	hash = pi.CalcHash()
+
+	/* DER, with the TLV's zero padding removed. */
+	alg, der, err := pi.GetSignature(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ecSig ECDSASig
+	rest, err := asn1.Unmarshal(der, &ecSig)
+	if err != nil || len(rest) != 0 {
+		t.Fatalf("bad DER signature: err=%v trailing=%d", err, len(rest))
+	}
+	if alg != "ECDSA224" ||
+		!ecdsa.Verify(&ecKey.PublicKey, hash, ecSig.R, ecSig.S) {
+
+		t.Fatal("DER signature does not verify")
+	}
+
+	/* Fixed-width r || s. */
+	_, raw, err := pi.GetSignature(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != 2*ECDSA224_SCALAR_LEN {
+		t.Fatalf("raw signature length %d", len(raw))
+	}
+	r := new(big.Int).SetBytes(raw[:ECDSA224_SCALAR_LEN])
+	s := new(big.Int).SetBytes(raw[ECDSA224_SCALAR_LEN:])
+	if !ecdsa.Verify(&ecKey.PublicKey, hash, r, s) {
+		t.Fatal("raw signature does not verify")
+	}
+}
+
+func TestDescribeTlvs(t *testing.T) {
+	_, ecKey := testKeys(t)
+	image := newTestImage(t, "1.0.0")
+	image.SetSigningPrivateKey(ecKey, 0)
+	image.SetHashScope(HASH_SCOPE_BODY)
+	image.SetVcsHash("1f2e3d4c")
+	_, pi := generateTestImage(t, image, testBody(10))
+	pi.HashScope = HASH_SCOPE_BODY
+
+	/* The generator and a parsed copy of its output agree. */
+	descs := pi.DescribeTlvs()
+	genDescs := image.DescribeTlvs()
+	if len(descs) != 3 || len(genDescs) != len(descs) {
+		t.Fatalf("%d and %d TLV descriptions", len(descs), len(genDescs))
+	}
+	for i, _ := range descs {
+		if descs[i] != genDescs[i] {
+			t.Errorf("parsed %+v; generated %+v", descs[i], genDescs[i])
+		}
+	}
+
+	if descs[0].Description != "SHA256 of body" || !descs[0].Security {
+		t.Errorf("hash TLV described as %+v", descs[0])
+	}
+	if descs[1].Name != "ECDSA224" || descs[1].Len != 68 {
+		t.Errorf("signature TLV described as %+v", descs[1])
+	}
+	if descs[2].Name != "VCS_HASH" || descs[2].Security {
+		t.Errorf("VCS TLV described as %+v", descs[2])
+	}
+}
+
+func gzipData(t *testing.T, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadImageGzip(t *testing.T) {
+	data1, _ := generateTestImage(t, newTestImage(t, "1.0.0"), testBody(100))
+	data2, _ := generateTestImage(t, newTestImage(t, "2.0.0"), testBody(200))
+
+	pi, err := ReadImage(bytes.NewReader(gzipData(t, data1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pi.VerifyHash(); err != nil {
+		t.Fatal(err)
+	}
+
+	both := append(append([]byte{}, data1...), data2...)
+	images, err := ReadImages(bytes.NewReader(gzipData(t, both)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || images[1].Hdr.Vers.Major != 2 {
+		t.Fatalf("read %d images from gzip stream", len(images))
+	}
+
+	/* Uncompressed input is read no further than the image. */
+	r := bytes.NewReader(both)
+	if _, err := ReadImage(r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != len(data2) {
+		t.Fatalf("%d bytes left after first image; expected %d", r.Len(),
+			len(data2))
+	}
+}
@@ -0,0 +1,171 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+	"math"
+
+	"mynewt.apache.org/newt/util"
+)
+
+/*
+ * Recomputes the hash and signature TLVs after the header or body has been
+ * changed.  Any existing signatures are replaced with ones made with the
+ * given keys (*rsa.PrivateKey or *ecdsa.PrivateKey), and the header's key ID
+ * is set to keyId.  Other TLVs are kept.
+ */
+func (pi *ParsedImage) resign(keys []crypto.PrivateKey, keyId uint8) error {
+	/*
+	 * Keep the image's hash algorithm.  Signatures are only defined over
+	 * SHA256.
+	 */
+	alg := pi.HashAlg()
+	if len(keys) > 0 && alg.TlvType != IMAGE_TLV_SHA256 {
+		return util.NewNewtError(fmt.Sprintf("Cannot sign image hashed "+
+			"with %s; signatures require %s", alg.Name, HASH_ALG_SHA256))
+	}
+	for _, other := range hashAlgs {
+		pi.Hdr.Flags &^= other.Flag
+	}
+	pi.Hdr.Flags &^= IMAGE_F_PKCS15_RSA2048_SHA256 | IMAGE_F_ECDSA224_SHA256
+	pi.Hdr.Flags |= alg.Flag
+
+	/* As with generated images, an unsigned image has no key ID. */
+	pi.Hdr.KeyId = 0
+	if len(keys) > 0 {
+		pi.Hdr.KeyId = keyId
+	}
+
+	/*
+	 * The header is covered by the hash, so the flags and TLV size must be
+	 * final before hashing.  Lay the trailer out with placeholder hash and
+	 * signature data of the final lengths; signatures have a fixed size.
+	 */
+	tlvs := []ParsedTlv{newParsedTlv(alg.TlvType,
+		make([]byte, alg.New().Size()))}
+	for _, key := range keys {
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			if err := checkRsaKeySize(k); err != nil {
+				return err
+			}
+			pi.Hdr.Flags |= IMAGE_F_PKCS15_RSA2048_SHA256
+			tlvs = append(tlvs, newParsedTlv(IMAGE_TLV_RSA2048,
+				make([]byte, RSA2048_SIG_LEN)))
+		case *ecdsa.PrivateKey:
+			pi.Hdr.Flags |= IMAGE_F_ECDSA224_SHA256
+			tlvs = append(tlvs, newParsedTlv(IMAGE_TLV_ECDSA224,
+				make([]byte, 68)))
+		default:
+			return util.NewNewtError(fmt.Sprintf("Unsupported private "+
+				"key type %T", key))
+		}
+	}
+
+	for _, tlv := range pi.Tlvs {
+		if !isHashTlv(tlv.Hdr.Type) && !isSigTlv(tlv.Hdr.Type) {
+			tlvs = append(tlvs, tlv)
+		}
+	}
+
+	/*
+	 * The body may have changed size, so every TLV's padding is
+	 * recomputed to keep the trailer aligned.
+	 */
+	tlvSz := pi.padTlvs(tlvs)
+	if tlvSz > math.MaxUint16 {
+		return util.NewNewtError(fmt.Sprintf("Image trailer too large (%d "+
+			"bytes)", tlvSz))
+	}
+	pi.Hdr.TlvSz = uint16(tlvSz)
+
+	hash := pi.CalcHash()
+	tlvs[0].Data = hash
+	for i, key := range keys {
+		var sig []byte
+		var err error
+
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			sig, err = signRsa(k, hash)
+		case *ecdsa.PrivateKey:
+			sig, err = signEc(k, hash)
+		}
+		if err != nil {
+			return err
+		}
+		if len(sig) != len(tlvs[i+1].Data) {
+			return util.NewNewtError(fmt.Sprintf("Unexpected %s signature "+
+				"length %d", TlvTypeName(tlvs[i+1].Hdr.Type), len(sig)))
+		}
+		tlvs[i+1].Data = sig
+	}
+	pi.Tlvs = tlvs
+
+	return nil
+}
+
+/*
+ * Replaces the image body, then rehashes and re-signs the image.  keyId
+ * identifies the signing keys, as with Image.SetSigningPrivateKey().  If
+ * slotSize is nonzero, the resulting image must fit in a slot of that size.
+ * The image is left unchanged on error.
+ */
+func (pi *ParsedImage) ReplaceBody(newBody []byte, keys []crypto.PrivateKey,
+	keyId uint8, slotSize int) error {
+
+	if !pi.WideHdr() && uint64(len(newBody)) > math.MaxUint32 {
+		return util.NewNewtError(fmt.Sprintf("Body too large for image "+
+			"header (%d bytes)", len(newBody)))
+	}
+
+	/*
+	 * As with generated images, the body is zero-padded so that an aligned
+	 * trailer starts at an aligned offset.
+	 */
+	pad := alignPad(int(pi.Hdr.HdrSz)+len(newBody), pi.TlvAlign)
+	if pad != 0 {
+		newBody = append(newBody[:len(newBody):len(newBody)],
+			make([]byte, pad)...)
+	}
+
+	np := *pi
+	np.Body = newBody
+	if np.WideHdr() {
+		np.ImgSz64 = uint64(len(newBody))
+	} else {
+		np.Hdr.ImgSz = uint32(len(newBody))
+	}
+	if err := np.resign(keys, keyId); err != nil {
+		return err
+	}
+
+	if slotSize != 0 && np.TotalSize() > slotSize {
+		return util.NewNewtError(fmt.Sprintf("Image too large for slot; "+
+			"image=%d slot=%d", np.TotalSize(), slotSize))
+	}
+
+	*pi = np
+	return nil
+}
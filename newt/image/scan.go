@@ -0,0 +1,111 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"mynewt.apache.org/newt/util"
+)
+
+/*
+ * Image located in a raw flash dump.
+ */
+type FoundImage struct {
+	Offset int
+	Image  *ParsedImage /* nil if the image could not be parsed */
+	Valid  bool         /* Structure and hash check out */
+	Err    error        /* Reason the image is not valid */
+}
+
+/*
+ * Walks a flash dump sector by sector, looking for image headers.  Each
+ * candidate is parsed and its hash is checked.  Scanning resumes at the
+ * first sector past a valid image, so headers inside its body are not
+ * mistaken for images.
+ */
+func ScanFlashForImages(data []byte, sectorSize int) ([]FoundImage, error) {
+	if sectorSize <= 0 {
+		return nil, util.NewNewtError(fmt.Sprintf("Invalid sector size %d",
+			sectorSize))
+	}
+
+	found := []FoundImage{}
+	off := 0
+	for off+IMAGE_HEADER_SIZE <= len(data) {
+		fi, ok := scanImageAt(data, off)
+		if !ok {
+			off += sectorSize
+			continue
+		}
+		found = append(found, fi)
+
+		step := sectorSize
+		if fi.Valid {
+			sz := fi.Image.TotalSize()
+			step = (sz + sectorSize - 1) / sectorSize * sectorSize
+		}
+		off += step
+	}
+
+	return found, nil
+}
+
+/*
+ * Checks for an image at offset off of a flash dump.  Returns false if
+ * there is no image magic there.
+ */
+func scanImageAt(data []byte, off int) (FoundImage, bool) {
+	magic := binary.LittleEndian.Uint32(data[off:])
+	if magic != IMAGE_MAGIC && magic != IMAGE_MAGIC_64 {
+		return FoundImage{}, false
+	}
+
+	fi := FoundImage{Offset: off}
+
+	/*
+	 * Check the sizes in the header against the rest of the dump before
+	 * parsing; a corrupt or erased header can claim any size.
+	 */
+	hdr := &ParsedImage{}
+	if err := hdr.readHdr(bytes.NewReader(data[off:])); err != nil {
+		fi.Err = err
+		return fi, true
+	}
+	avail := len(data) - off
+	if hdr.BodySize() > uint64(avail) || hdr.TotalSize() > avail {
+		fi.Err = util.NewNewtError(fmt.Sprintf("Image extends past the "+
+			"end of the dump; %d bytes left", avail))
+		return fi, true
+	}
+
+	fi.Image, fi.Err = ReadImage(bytes.NewReader(data[off:]))
+	if fi.Err == nil {
+		fi.Err = fi.Image.VerifyStructure()
+	}
+	if fi.Err == nil {
+		fi.Err = fi.Image.VerifyHash()
+	}
+	fi.Valid = fi.Err == nil
+
+	return fi, true
+}
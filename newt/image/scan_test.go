@@ -0,0 +1,78 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+const testSectorSize = 256
+
+func TestScanFlashErased(t *testing.T) {
+	/* Erased flash with a stray 64-bit magic claiming a huge image. */
+	dump := bytes.Repeat([]byte{0xff}, 4*testSectorSize)
+	binary.LittleEndian.PutUint32(dump[testSectorSize:], IMAGE_MAGIC_64)
+
+	found, err := ScanFlashForImages(dump, testSectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Valid || found[0].Err == nil {
+		t.Fatalf("unexpected scan result %+v", found)
+	}
+}
+
+func TestScanFlashTwoImages(t *testing.T) {
+	/*
+	 * The first image's body contains what looks like a header at a
+	 * sector boundary; it must not be reported.
+	 */
+	body := testBody(3 * testSectorSize)
+	binary.LittleEndian.PutUint32(body[2*testSectorSize-IMAGE_HEADER_SIZE:],
+		IMAGE_MAGIC)
+	img1, _ := generateTestImage(t, newTestImage(t, "1.0.0"), body)
+	img2, _ := generateTestImage(t, newTestImage(t, "2.0.0"),
+		testBody(100))
+
+	slot := 8 * testSectorSize
+	dump := bytes.Repeat([]byte{0xff}, 2*slot)
+	copy(dump, img1)
+	copy(dump[slot:], img2)
+
+	found, err := ScanFlashForImages(dump, testSectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 {
+		t.Fatalf("found %d images; expected 2", len(found))
+	}
+	for i, off := range []int{0, slot} {
+		if found[i].Offset != off {
+			t.Errorf("image %d at offset %d; expected %d", i,
+				found[i].Offset, off)
+		}
+	}
+	for i, _ := range found {
+		if !found[i].Valid {
+			t.Errorf("image %d invalid: %v", i, found[i].Err)
+		}
+	}
+}
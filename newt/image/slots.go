@@ -0,0 +1,98 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"fmt"
+
+	"mynewt.apache.org/newt/util"
+)
+
+/*
+ * One copy of an image destined for a particular flash slot.  For
+ * position-independent code, every slot can share the same app binary;
+ * otherwise each slot needs a binary linked for its base address.
+ */
+type ImageSlot struct {
+	Base      int    /* Flash address of the slot */
+	SourceBin string /* App binary; empty means the image's own */
+	TargetImg string /* Where to write this slot's .img */
+
+	/* Filled in by GenerateSlots(). */
+	Hash []byte
+	Size int
+}
+
+/*
+ * Generates one image per slot, all sharing this image's version, keys and
+ * TLV options.  Fails if the slots overlap or if any resulting image does
+ * not fit in slotSize bytes.
+ */
+func (image *Image) GenerateSlots(slots []*ImageSlot, slotSize int) error {
+	if slotSize <= 0 {
+		return util.NewNewtError(fmt.Sprintf("Invalid slot size %d",
+			slotSize))
+	}
+
+	for i, a := range slots {
+		for _, b := range slots[i+1:] {
+			if a.Base < b.Base+slotSize && b.Base < a.Base+slotSize {
+				return util.NewNewtError(fmt.Sprintf("Slots at 0x%x and "+
+					"0x%x overlap (slot size 0x%x)", a.Base, b.Base,
+					slotSize))
+			}
+		}
+	}
+
+	for _, slot := range slots {
+		if slot.TargetImg == "" {
+			return util.NewNewtError(fmt.Sprintf("No target image for "+
+				"slot at 0x%x", slot.Base))
+		}
+
+		/*
+		 * Generate from a copy so that the slots don't share any state.
+		 */
+		dup := *image
+		dup.infoTlvs = append([]infoTlv(nil), image.infoTlvs...)
+		dup.targetImg = slot.TargetImg
+		if slot.SourceBin != "" {
+			dup.sourceBin = slot.SourceBin
+			dup.fromElf = false
+		}
+
+		util.StatusMessage(util.VERBOSITY_VERBOSE,
+			"Generating image for slot at 0x%x: %s\n", slot.Base,
+			slot.TargetImg)
+		if err := dup.Generate(); err != nil {
+			return err
+		}
+		if dup.totalSize > slotSize {
+			return util.NewNewtError(fmt.Sprintf("Image for slot at 0x%x "+
+				"too large; image=%d slot=%d", slot.Base, dup.totalSize,
+				slotSize))
+		}
+
+		slot.Hash = dup.hash
+		slot.Size = dup.totalSize
+	}
+
+	return nil
+}
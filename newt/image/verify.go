@@ -0,0 +1,463 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"mynewt.apache.org/newt/util"
+)
+
+func ReadPublicKey(fileName string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, util.NewNewtError(fmt.Sprintf("Error reading key file: "+
+			"%s", err))
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, util.NewNewtError("Unknown public key format, " +
+			"PKIX public key in PEM format only.")
+	}
+
+	pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, util.NewNewtError(fmt.Sprintf("Public key parsing "+
+			"failed: %s", err))
+	}
+
+	return pubKey, nil
+}
+
+type flagTlv struct {
+	flag    uint32
+	tlvType uint8
+	tlvLen  int
+}
+
+/*
+ * Expected TLV for each signature header flag.
+ */
+var flagTlvs = []flagTlv{
+	{IMAGE_F_PKCS15_RSA2048_SHA256, IMAGE_TLV_RSA2048, RSA2048_SIG_LEN},
+	{IMAGE_F_ECDSA224_SHA256, IMAGE_TLV_ECDSA224, 68},
+}
+
+/*
+ * Expected TLV for each header flag, including those of every registered
+ * hash algorithm.
+ */
+func allFlagTlvs() []flagTlv {
+	fts := []flagTlv{}
+	for _, alg := range sortedHashAlgs() {
+		fts = append(fts,
+			flagTlv{alg.Flag, alg.TlvType, alg.New().Size()})
+	}
+	return append(fts, flagTlvs...)
+}
+
+/*
+ * Sanity checks the image layout, so that malformed images are rejected
+ * before any crypto verification runs.
+ */
+func (pi *ParsedImage) VerifyStructure() error {
+	/*
+	 * The regions actually present must add up to the size the header
+	 * claims.  ReadImage() only reads the regions the header describes, so
+	 * this catches images modified after parsing; trailing data in an image
+	 * file is caught by ReadImageFile().
+	 */
+	size := IMAGE_HEADER_SIZE + len(pi.HdrPad) + len(pi.Body)
+	for _, tlv := range pi.Tlvs {
+		size += 4 + len(tlv.Data) + int(tlv.Hdr.Pad)
+	}
+	if size != pi.TotalSize() {
+		return util.NewNewtError(fmt.Sprintf("Image size mismatch; "+
+			"header indicates %d bytes (hdr=%d body=%d trailer=%d), "+
+			"have %d", pi.TotalSize(), pi.Hdr.HdrSz, pi.BodySize(),
+			pi.Hdr.TlvSz, size))
+	}
+
+	for _, ft := range allFlagTlvs() {
+		tlv := pi.FindTlv(ft.tlvType)
+		if pi.Hdr.Flags&ft.flag == 0 {
+			if tlv != nil {
+				return util.NewNewtError(fmt.Sprintf("Image contains %s "+
+					"TLV, but flags 0x%x lack 0x%x", TlvTypeName(ft.tlvType),
+					pi.Hdr.Flags, ft.flag))
+			}
+			continue
+		}
+		if tlv == nil {
+			return util.NewNewtError(fmt.Sprintf("Image flags 0x%x "+
+				"indicate %s TLV, but none present", pi.Hdr.Flags,
+				TlvTypeName(ft.tlvType)))
+		}
+		if len(tlv.Data) != ft.tlvLen {
+			return util.NewNewtError(fmt.Sprintf("%s TLV has wrong length; "+
+				"have=%d want=%d", TlvTypeName(ft.tlvType), len(tlv.Data),
+				ft.tlvLen))
+		}
+	}
+
+	return nil
+}
+
+/*
+ * Checks that the hash TLV matches the header and body.
+ */
+func (pi *ParsedImage) VerifyHash() error {
+	tlv, err := pi.HashTlv()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(tlv.Data, pi.CalcHash()) {
+		return util.NewNewtError("Image hash mismatch")
+	}
+
+	return nil
+}
+
+func verifySigTlv(tlv *ParsedTlv, hash []byte,
+	pubKey crypto.PublicKey) error {
+
+	switch key := pubKey.(type) {
+	case *rsa.PublicKey:
+		if tlv.Hdr.Type != IMAGE_TLV_RSA2048 {
+			return util.NewNewtError(fmt.Sprintf("RSA key cannot verify %s "+
+				"signature", TlvTypeName(tlv.Hdr.Type)))
+		}
+		err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash, tlv.Data)
+		if err != nil {
+			return util.NewNewtError(fmt.Sprintf("RSA signature "+
+				"verification failed: %s", err))
+		}
+
+	case *ecdsa.PublicKey:
+		if tlv.Hdr.Type != IMAGE_TLV_ECDSA224 {
+			return util.NewNewtError(fmt.Sprintf("EC key cannot verify %s "+
+				"signature", TlvTypeName(tlv.Hdr.Type)))
+		}
+		/* Signature is DER, zero-padded to the TLV length. */
+		var sig ECDSASig
+		if _, err := asn1.Unmarshal(tlv.Data, &sig); err != nil {
+			return util.NewNewtError(fmt.Sprintf("Bad ECDSA signature: %s",
+				err))
+		}
+		if !ecdsa.Verify(key, hash, sig.R, sig.S) {
+			return util.NewNewtError("ECDSA signature verification failed")
+		}
+
+	default:
+		return util.NewNewtError(fmt.Sprintf("Unsupported public key "+
+			"type %T", pubKey))
+	}
+
+	return nil
+}
+
+/*
+ * Checks the image signature against the given public key.  The hash TLV
+ * must already have been verified.
+ */
+func (pi *ParsedImage) VerifySig(pubKey crypto.PublicKey) error {
+	hash, err := pi.HashTlv()
+	if err != nil {
+		return err
+	}
+
+	var tlv *ParsedTlv
+	switch pubKey.(type) {
+	case *rsa.PublicKey:
+		tlv = pi.FindTlv(IMAGE_TLV_RSA2048)
+		if tlv == nil {
+			return util.NewNewtError("Image has no RSA signature")
+		}
+
+	case *ecdsa.PublicKey:
+		tlv = pi.FindTlv(IMAGE_TLV_ECDSA224)
+		if tlv == nil {
+			return util.NewNewtError("Image has no ECDSA signature")
+		}
+
+	default:
+		return util.NewNewtError(fmt.Sprintf("Unsupported public key "+
+			"type %T", pubKey))
+	}
+
+	return verifySigTlv(tlv, hash.Data, pubKey)
+}
+
+/*
+ * Result of checking one signature TLV.
+ */
+type SigResult struct {
+	TlvType uint8
+	Err     error /* nil if the signature is valid */
+}
+
+/*
+ * Verifies each signature TLV in the image against the corresponding key;
+ * the n'th signature TLV is checked with pubKeys[n].  Used when an image is
+ * signed with both an old and a new key during key migration.  The image
+ * structure and hash are checked first; if either is bad, an error is
+ * returned instead of per-signature results.
+ */
+func (pi *ParsedImage) VerifySigs(
+	pubKeys []crypto.PublicKey) ([]SigResult, error) {
+
+	if err := pi.VerifyStructure(); err != nil {
+		return nil, err
+	}
+	if err := pi.VerifyHash(); err != nil {
+		return nil, err
+	}
+
+	hash, err := pi.HashTlv()
+	if err != nil {
+		return nil, err
+	}
+
+	sigTlvs := []*ParsedTlv{}
+	for i, _ := range pi.Tlvs {
+		if isSigTlv(pi.Tlvs[i].Hdr.Type) {
+			sigTlvs = append(sigTlvs, &pi.Tlvs[i])
+		}
+	}
+	if len(sigTlvs) != len(pubKeys) {
+		return nil, util.NewNewtError(fmt.Sprintf("Image has %d "+
+			"signatures, but %d keys given", len(sigTlvs), len(pubKeys)))
+	}
+
+	results := make([]SigResult, len(sigTlvs))
+	for i, tlv := range sigTlvs {
+		results[i].TlvType = tlv.Hdr.Type
+		results[i].Err = verifySigTlv(tlv, hash.Data, pubKeys[i])
+	}
+
+	return results, nil
+}
+
+type VerifyOpts struct {
+	RequireSignature bool             /* Fail unless a signature verifies */
+	PubKey           crypto.PublicKey /* Key to check signatures with */
+}
+
+/*
+ * Outcome of a successful Verify().
+ */
+const (
+	VERIFY_UNSIGNED      = 0 /* Hash ok; image carries no signature */
+	VERIFY_SIG_UNCHECKED = 1 /* Hash ok; signed, but no key was given */
+	VERIFY_SIG_VALID     = 2 /* Hash ok; signature verified */
+)
+
+/*
+ * Checks the image structure and hash, and the signature if a key is
+ * given.  Unsigned images pass unless opts.RequireSignature is set, which
+ * lets development (hash only) and release (hash and signature) gates share
+ * one code path.
+ */
+func (pi *ParsedImage) Verify(opts VerifyOpts) (int, error) {
+	if err := pi.VerifyStructure(); err != nil {
+		return 0, err
+	}
+	if err := pi.VerifyHash(); err != nil {
+		return 0, err
+	}
+
+	signed := false
+	for _, tlv := range pi.Tlvs {
+		if isSigTlv(tlv.Hdr.Type) {
+			signed = true
+		}
+	}
+
+	switch {
+	case !signed && opts.RequireSignature:
+		return 0, util.NewNewtError("Image is not signed")
+	case !signed:
+		return VERIFY_UNSIGNED, nil
+	case opts.PubKey == nil && opts.RequireSignature:
+		return 0, util.NewNewtError("No public key to verify signature " +
+			"with")
+	case opts.PubKey == nil:
+		return VERIFY_SIG_UNCHECKED, nil
+	}
+
+	if err := pi.VerifySig(opts.PubKey); err != nil {
+		return 0, err
+	}
+
+	return VERIFY_SIG_VALID, nil
+}
+
+type VerifyResult struct {
+	Status int /* VERIFY_[...]; valid if Err is nil */
+	Err    error
+}
+
+/*
+ * Verifies many images concurrently, using the given number of worker
+ * goroutines.  images[i] must carry a valid signature made with the key
+ * matching pubKeys[i].  Results are returned in the same order as the
+ * images.
+ */
+func VerifyBatch(images []*ParsedImage, pubKeys []crypto.PublicKey,
+	workers int) ([]VerifyResult, error) {
+
+	if len(images) != len(pubKeys) {
+		return nil, util.NewNewtError(fmt.Sprintf("Image count (%d) does "+
+			"not match key count (%d)", len(images), len(pubKeys)))
+	}
+	if workers <= 0 {
+		return nil, util.NewNewtError(fmt.Sprintf("Invalid worker count %d",
+			workers))
+	}
+
+	results := make([]VerifyResult, len(images))
+	idxs := make(chan int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range idxs {
+				opts := VerifyOpts{
+					RequireSignature: true,
+					PubKey:           pubKeys[idx],
+				}
+				results[idx].Status, results[idx].Err =
+					images[idx].Verify(opts)
+			}
+		}()
+	}
+
+	for i, _ := range images {
+		idxs <- i
+	}
+	close(idxs)
+	wg.Wait()
+
+	return results, nil
+}
+
+/*
+ * Reads the image and the PEM public key from disk, and verifies the image
+ * hash and signature.
+ */
+func VerifyImageFile(imgPath string, pubKeyPath string) error {
+	pubKey, err := ReadPublicKey(pubKeyPath)
+	if err != nil {
+		return err
+	}
+
+	pi, err := ReadImageFile(imgPath)
+	if err != nil {
+		return err
+	}
+
+	if err := pi.VerifyStructure(); err != nil {
+		return err
+	}
+
+	if err := pi.VerifyHash(); err != nil {
+		return err
+	}
+
+	return pi.VerifySig(pubKey)
+}
+
+/*
+ * Validates the leaf certificate's chain up to one of the trusted roots,
+ * then verifies the image signature with the leaf's public key.  The leaf
+ * must be valid for code signing; a certificate issued for some other
+ * purpose, such as a TLS server, is not accepted.
+ */
+func (pi *ParsedImage) VerifyWithCertChain(leaf *x509.Certificate,
+	intermediates []*x509.Certificate, roots []*x509.Certificate) error {
+
+	opts := x509.VerifyOptions{
+		Intermediates: x509.NewCertPool(),
+		Roots:         x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	for _, cert := range intermediates {
+		opts.Intermediates.AddCert(cert)
+	}
+	for _, cert := range roots {
+		opts.Roots.AddCert(cert)
+	}
+
+	if _, err := leaf.Verify(opts); err != nil {
+		return util.NewNewtError(fmt.Sprintf("Certificate chain "+
+			"verification failed: %s", err))
+	}
+
+	if err := pi.VerifyStructure(); err != nil {
+		return util.NewNewtError(fmt.Sprintf("Image verification failed: "+
+			"%s", err.(*util.NewtError).Text))
+	}
+	if err := pi.VerifyHash(); err != nil {
+		return util.NewNewtError(fmt.Sprintf("Image verification failed: "+
+			"%s", err.(*util.NewtError).Text))
+	}
+	if err := pi.VerifySig(leaf.PublicKey); err != nil {
+		return util.NewNewtError(fmt.Sprintf("Image signature "+
+			"verification failed: %s", err.(*util.NewtError).Text))
+	}
+
+	return nil
+}
+
+/*
+ * Checks that the image is exactly the expected artifact: its header
+ * version must equal wantVersion and its hash TLV must equal wantHash.
+ */
+func (pi *ParsedImage) ExpectImage(wantVersion ImageVersion,
+	wantHash []byte) error {
+
+	if pi.Hdr.Vers.Cmp(wantVersion) != 0 {
+		return util.NewNewtError(fmt.Sprintf("Image version mismatch; "+
+			"have=%s want=%s", pi.Hdr.Vers.String(), wantVersion.String()))
+	}
+
+	tlv, err := pi.HashTlv()
+	if err != nil {
+		return err
+	}
+	if !HashEqual(tlv.Data, wantHash) {
+		return util.NewNewtError(fmt.Sprintf("Image hash mismatch; "+
+			"have=%x want=%x", tlv.Data, wantHash))
+	}
+
+	return nil
+}
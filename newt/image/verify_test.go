@@ -0,0 +1,234 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package image
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+/*
+ * Issues a CA certificate and a leaf certificate for pubKey with the given
+ * extended key usage.
+ */
+func testCertChain(t *testing.T, pubKey crypto.PublicKey,
+	usage x509.ExtKeyUsage) (*x509.Certificate, *x509.Certificate) {
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl,
+		caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "test signer"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	leafDer, err := x509.CreateCertificate(rand.Reader, leafTmpl, ca,
+		pubKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(leafDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return leaf, ca
+}
+
+func TestVerifyWithCertChain(t *testing.T) {
+	rsaKey, _ := testKeys(t)
+	image := newTestImage(t, "1.0.0")
+	image.SetSigningPrivateKey(rsaKey, 0)
+	_, pi := generateTestImage(t, image, testBody(100))
+
+	leaf, ca := testCertChain(t, rsaKey.Public(), x509.ExtKeyUsageCodeSigning)
+	roots := []*x509.Certificate{ca}
+	if err := pi.VerifyWithCertChain(leaf, nil, roots); err != nil {
+		t.Fatal(err)
+	}
+
+	/* A TLS server certificate must not be accepted for signing images. */
+	leaf, ca = testCertChain(t, rsaKey.Public(), x509.ExtKeyUsageServerAuth)
+	roots = []*x509.Certificate{ca}
+	if err := pi.VerifyWithCertChain(leaf, nil, roots); err == nil {
+		t.Fatal("server auth certificate accepted")
+	}
+
+	/*
+	 * A trailer that disagrees with the header's TLV size leaves the hash
+	 * and signature intact; only the structure check catches it.
+	 */
+	leaf, ca = testCertChain(t, rsaKey.Public(), x509.ExtKeyUsageCodeSigning)
+	roots = []*x509.Certificate{ca}
+	pi.Tlvs = append(pi.Tlvs, newParsedTlv(IMAGE_TLV_VCS_HASH, []byte("x")))
+	if err := pi.VerifyWithCertChain(leaf, nil, roots); err == nil {
+		t.Fatal("image with bad trailer accepted")
+	}
+}
+
+func TestHashScopeCrossVerify(t *testing.T) {
+	_, ecKey := testKeys(t)
+	body := testBody(300)
+	scopes := []int{HASH_SCOPE_HDR_BODY, HASH_SCOPE_BODY}
+
+	for _, genScope := range scopes {
+		image := newTestImage(t, "1.0.0")
+		if err := image.SetHashScope(genScope); err != nil {
+			t.Fatal(err)
+		}
+		image.SetSigningPrivateKey(ecKey, 0)
+		_, pi := generateTestImage(t, image, body)
+
+		if genScope == HASH_SCOPE_BODY {
+			want := sha256.Sum256(body)
+			tlv := pi.FindTlv(IMAGE_TLV_SHA256)
+			if !bytes.Equal(tlv.Data, want[:]) {
+				t.Error("body-only hash is not SHA256 of the body")
+			}
+		}
+
+		/*
+		 * Verification succeeds only with the scope the image used.  The
+		 * signature covers the hash, so it is only trusted once the hash
+		 * checks out.
+		 */
+		opts := VerifyOpts{RequireSignature: true, PubKey: ecKey.Public()}
+		for _, verifyScope := range scopes {
+			pi.HashScope = verifyScope
+			hashErr := pi.VerifyHash()
+			_, err := pi.Verify(opts)
+			if verifyScope == genScope {
+				if hashErr != nil || err != nil {
+					t.Errorf("scope %d: hash=%v verify=%v", genScope,
+						hashErr, err)
+				}
+			} else if hashErr == nil || err == nil {
+				t.Errorf("scope %d image verified with scope %d",
+					genScope, verifyScope)
+			}
+		}
+	}
+}
+
+/*
+ * Signed images and matching keys for batch verification.
+ */
+func testBatch(t testing.TB, n int) ([]*ParsedImage, []crypto.PublicKey) {
+	_, ecKey := testKeys(t)
+
+	images := make([]*ParsedImage, n)
+	keys := make([]crypto.PublicKey, n)
+	for i, _ := range images {
+		image := newTestImage(t, "1.0.0")
+		image.SetSigningPrivateKey(ecKey, 0)
+		_, images[i] = generateTestImage(t, image, testBody(4096+i))
+		keys[i] = ecKey.Public()
+	}
+
+	return images, keys
+}
+
+func TestVerifyBatch(t *testing.T) {
+	images, keys := testBatch(t, 20)
+	images[7].Body[0] ^= 0xff
+
+	results, err := VerifyBatch(images, keys, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, res := range results {
+		if (res.Err != nil) != (i == 7) {
+			t.Errorf("image %d: %v", i, res.Err)
+		}
+	}
+}
+
+func BenchmarkVerifyBatch(b *testing.B) {
+	images, keys := testBatch(b, 200)
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := VerifyBatch(images, keys, workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifySigs(t *testing.T) {
+	rsaKey, ecKey := testKeys(t)
+	image := newTestImage(t, "1.0.0")
+	image.SetSigningPrivateKey(rsaKey, 0)
+	image.SetSigningPrivateKey(ecKey, 0)
+	_, pi := generateTestImage(t, image, testBody(100))
+
+	keys := []crypto.PublicKey{rsaKey.Public(), ecKey.Public()}
+	results, err := pi.VerifySigs(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range results {
+		if res.Err != nil {
+			t.Errorf("%s: %v", TlvTypeName(res.TlvType), res.Err)
+		}
+	}
+
+	/* The signatures still match the hash TLV, but not the body. */
+	pi.Body[0] ^= 0xff
+	if _, err := pi.VerifySigs(keys); err == nil {
+		t.Fatal("tampered body accepted")
+	}
+}
@@ -0,0 +1,147 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"mynewt.apache.org/newt/util"
+)
+
+/*
+ * Returns -1, 0 or 1 if v is less than, equal to, or greater than other.
+ */
+func (v ImageVersion) Cmp(other ImageVersion) int {
+	a := []uint64{uint64(v.Major), uint64(v.Minor), uint64(v.Rev),
+		uint64(v.BuildNum)}
+	b := []uint64{uint64(other.Major), uint64(other.Minor),
+		uint64(other.Rev), uint64(other.BuildNum)}
+
+	for i, _ := range a {
+		if a[i] < b[i] {
+			return -1
+		}
+		if a[i] > b[i] {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+/*
+ * Comparison operators accepted in version constraints.  Longer operators
+ * must come first so that ">=" is not taken for ">".
+ */
+var versionOps = []struct {
+	op string
+	ok func(cmp int) bool
+}{
+	{">=", func(cmp int) bool { return cmp >= 0 }},
+	{"<=", func(cmp int) bool { return cmp <= 0 }},
+	{"==", func(cmp int) bool { return cmp == 0 }},
+	{"!=", func(cmp int) bool { return cmp != 0 }},
+	{">", func(cmp int) bool { return cmp > 0 }},
+	{"<", func(cmp int) bool { return cmp < 0 }},
+	{"=", func(cmp int) bool { return cmp == 0 }},
+}
+
+/*
+ * Checks a version against a constraint such as ">=1.2.0 <2.0.0".  The
+ * constraint is a whitespace separated list of clauses, all of which must
+ * hold.  A clause without an operator requires an exact match.
+ */
+func VersionSatisfies(v ImageVersion, constraint string) (bool, error) {
+	clauses := strings.Fields(constraint)
+	if len(clauses) == 0 {
+		return false, util.NewNewtError("Empty version constraint")
+	}
+
+	for _, clause := range clauses {
+		ok := func(cmp int) bool { return cmp == 0 }
+		versStr := clause
+		for _, vo := range versionOps {
+			if strings.HasPrefix(clause, vo.op) {
+				ok = vo.ok
+				versStr = strings.TrimPrefix(clause, vo.op)
+				break
+			}
+		}
+
+		other, err := ParseVersion(versStr)
+		if err != nil {
+			return false, util.NewNewtError(fmt.Sprintf("Invalid version "+
+				"constraint \"%s\"", constraint))
+		}
+		if !ok(v.Cmp(other)) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (pi *ParsedImage) CheckVersionConstraint(
+	constraint string) (bool, error) {
+
+	return VersionSatisfies(pi.Hdr.Vers, constraint)
+}
+
+/*
+ * Returns the minimum previous version from the image's MIN_PREV TLV.  The
+ * boolean is false if the image carries no such TLV.
+ */
+func (pi *ParsedImage) MinPrevVersion() (ImageVersion, bool, error) {
+	var vers ImageVersion
+
+	tlv := pi.FindTlv(IMAGE_TLV_MIN_PREV)
+	if tlv == nil {
+		return vers, false, nil
+	}
+	if len(tlv.Data) != binary.Size(vers) {
+		return vers, false, util.NewNewtError(fmt.Sprintf("Bad MIN_PREV "+
+			"TLV length %d", len(tlv.Data)))
+	}
+	binary.Read(bytes.NewReader(tlv.Data), binary.LittleEndian, &vers)
+
+	return vers, true, nil
+}
+
+/*
+ * Decides whether a device running the installed version may take this
+ * image, based on the image's minimum previous version.  Images without
+ * one are accepted from any version.
+ */
+func (pi *ParsedImage) AcceptsUpgradeFrom(installed ImageVersion) error {
+	minPrev, ok, err := pi.MinPrevVersion()
+	if err != nil {
+		return err
+	}
+	if ok && installed.Cmp(minPrev) < 0 {
+		return util.NewNewtError(fmt.Sprintf("Image %s requires version "+
+			"%s or later to be installed; have %s", pi.Hdr.Vers.String(),
+			minPrev.String(), installed.String()))
+	}
+
+	return nil
+}